@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/rnidev/go-rest/pkg/auth"
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+// authRealm is the realm of the WWW-Authenticate challenges
+const authRealm = "go-rest"
+
+// EnableAuth requires the credentials enabled in cfg on the user routes, and
+// the role each route declares in setRoutes. They stay open when cfg enables
+// none.
+func (app *App) EnableAuth(cfg config.AuthConfig) error {
+	var authenticators []auth.Authenticator
+	if cfg.APIKeys {
+		authenticators = append(authenticators, auth.NewAPIKeys(app.pool))
+	}
+	if cfg.JWT() {
+		verifier, err := auth.NewJWT(auth.JWTOptions{
+			Secret:   cfg.JWTSecret,
+			JWKSFile: cfg.JWKSFile,
+			Issuer:   cfg.JWTIssuer,
+			Audience: cfg.JWTAudience,
+		})
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, verifier)
+	}
+	if cfg.RolesHeader != "" {
+		authenticators = append(authenticators, auth.RolesHeader{Header: cfg.RolesHeader, SubjectHeader: cfg.SubjectHeader})
+	}
+	app.auth = auth.NewMiddleware(authRealm, renderAuthErrorResp, authenticators...)
+	return nil
+}
+
+// authenticate lets through the requests accepted by app.auth, with their
+// principal in the request context
+func (app *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.auth.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		app.auth.Handler(next).ServeHTTP(w, r)
+	})
+}
+
+// require serves the requests of principals with role, and the others with
+// 403 Forbidden. Every request is served when authentication is disabled.
+func (app *App) require(role auth.Role, handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.auth.Enabled() {
+			handler(w, r)
+			return
+		}
+		principal := auth.FromContext(r.Context())
+		if !principal.HasRole(role) {
+			renderForbiddenResp(w, r, principal, role)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// renderForbiddenResp tells which role was required and which the caller has
+func renderForbiddenResp(w http.ResponseWriter, r *http.Request, principal *auth.Principal, role auth.Role) {
+	roles := []string{}
+	if principal != nil && principal.Roles != nil {
+		roles = principal.Roles
+	}
+	renderProblem(w, r, problemForbidden.New("the "+string(role)+" role is required", r.URL.Path).
+		With("required_role", role).
+		With("roles", roles))
+}
+
+// renderAuthErrorResp reports why the credentials of r were rejected, the
+// errors of the authenticators are meant for clients. Credentials that could
+// not be checked are an internal error, masked by renderErrorResp.
+func renderAuthErrorResp(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if status != http.StatusUnauthorized {
+		renderErrorResp(w, r, err)
+		return
+	}
+	unauthorized := problemUnauthorized
+	unauthorized.Status = status
+	renderProblem(w, r, unauthorized.New(err.Error(), r.URL.Path))
+}
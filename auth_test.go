@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/auth"
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+// hs256Token signs a token for subject with secret, valid for an hour
+func hs256Token(secret, subject string, roles ...string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims := `{"sub":"` + subject + `","exp":` + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	if len(roles) > 0 {
+		claims += `,"roles":["` + roles[0]
+		for _, role := range roles[1:] {
+			claims += `","` + role
+		}
+		claims += `"]`
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString([]byte(claims+"}"))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestAuthentication(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{APIKeys: true, JWTSecret: "jwt secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.NewAPIKeys(app.pool).Add(context.Background(), "valid-key", auth.Principal{Subject: "ci", Roles: []string{"reader"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path   string
+		header string
+		value  string
+		status int
+	}{
+		{"/users", "", "", http.StatusUnauthorized},
+		{"/users", "X-API-Key", "wrong-key", http.StatusUnauthorized},
+		{"/users", "Authorization", "Bearer " + hs256Token("other secret", "alice"), http.StatusUnauthorized},
+		{"/users", "X-API-Key", "valid-key", http.StatusOK},
+		{"/users", "Authorization", "Bearer " + hs256Token("jwt secret", "alice", "reader"), http.StatusOK},
+		{"/user/124", "Authorization", "ApiKey valid-key", http.StatusNotFound},
+		{"/healthz", "", "", http.StatusOK},
+		{"/metrics", "", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s with %s: http status code: got %v, expected %v", test.path, test.header, rr.Code, test.status)
+		}
+		if test.status == http.StatusUnauthorized {
+			challenges := rr.Header()["Www-Authenticate"]
+			if len(challenges) != 2 {
+				t.Errorf("%s with %s: WWW-Authenticate: got %q, expected ApiKey and Bearer challenges", test.path, test.header, challenges)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	expected := `{"type":"/problems/unauthorized","title":"Authentication required","status":401,"detail":"authentication required","instance":"/users","request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestAuthenticationPrincipal(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{JWTSecret: "jwt secret"}); err != nil {
+		t.Fatal(err)
+	}
+	var principal *auth.Principal
+	app.Router.Handle("/whoami", app.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal = auth.FromContext(r.Context())
+	})))
+
+	req, _ := http.NewRequest("GET", "/whoami", nil)
+	req.Header.Set("Authorization", "Bearer "+hs256Token("jwt secret", "alice", "reader"))
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	if principal == nil || principal.Subject != "alice" || principal.Method != "jwt" || len(principal.Roles) != 1 {
+		t.Errorf("principal: got %+v, expected alice authenticated by jwt with the reader role", principal)
+	}
+}
+
+func TestAuthenticationDisabled(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "/users", nil)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	defer conn.Close()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.EnableAuth(config.AuthConfig{JWTSecret: "jwt secret", RolesHeader: "X-Roles"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		role   string
+		status int
+	}{
+		{"GET", "/users", "", "", http.StatusForbidden},
+		{"GET", "/users", "", "reader", http.StatusOK},
+		{"GET", "/user/1", "", "reader", http.StatusOK},
+		{"POST", "/users", `{"name": "Jane"}`, "reader", http.StatusForbidden},
+		{"POST", "/users", `{"name": "Jane"}`, "writer", http.StatusCreated},
+		{"PUT", "/user/1", `{"name": "John", "age": 32}`, "writer", http.StatusOK},
+		{"PATCH", "/user/1", `{"age": 33}`, "reader", http.StatusForbidden},
+		{"GET", "/user/1", "", "writer", http.StatusOK},
+		{"DELETE", "/user/1", "", "writer", http.StatusForbidden},
+		{"DELETE", "/user/1", "", "admin", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if test.method == "PATCH" {
+			req.Header.Set("Content-Type", "application/merge-patch+json")
+		}
+		var roles []string
+		if test.role != "" {
+			roles = []string{test.role}
+		}
+		req.Header.Set("Authorization", "Bearer "+hs256Token("jwt secret", "alice", roles...))
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s %s as %q: http status code: got %v, expected %v", test.method, test.path, test.role, rr.Code, test.status)
+		}
+	}
+
+	//roles set by a trusted proxy, without credentials
+	req, _ := http.NewRequest("GET", "/user/2", nil)
+	req.Header.Set("X-Roles", "reader")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("roles header: http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if challenges := rr.Header()["Www-Authenticate"]; len(challenges) != 0 {
+		t.Errorf("WWW-Authenticate: got %q, expected none", challenges)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/user/2", nil)
+	req.Header.Set("X-Roles", "reader,writer")
+	req.Header.Set("X-Request-ID", "test-request")
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusForbidden)
+	}
+	expected := `{"type":"/problems/forbidden","title":"Forbidden","status":403,"detail":"the admin role is required","instance":"/user/2","request_id":"test-request","required_role":"admin","roles":["reader","writer"]}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestAuthenticationStoreUnavailable(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{APIKeys: true}); err != nil {
+		t.Fatal(err)
+	}
+	app.pool.Dial = func() (redis.Conn, error) {
+		return nil, errors.New("dial tcp 10.0.0.1:6379: connection refused")
+	}
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-API-Key", "valid-key")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusInternalServerError)
+	}
+	if challenges := rr.Header()["Www-Authenticate"]; len(challenges) != 0 {
+		t.Errorf("WWW-Authenticate: got %q, expected none", challenges)
+	}
+	if strings.Contains(rr.Body.String(), "10.0.0.1") {
+		t.Errorf("response body: got %v, expected the Redis error masked", rr.Body.String())
+	}
+}
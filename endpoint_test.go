@@ -2,12 +2,25 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/mux"
+	"github.com/rnidev/go-rest/pkg/config"
+	"github.com/rnidev/go-rest/pkg/logging"
+	v1 "github.com/rnidev/go-rest/pkg/service/v1"
 )
 
 func setup() *App {
@@ -15,8 +28,12 @@ func setup() *App {
 	if err != nil {
 		panic(err)
 	}
-	app := &App{}
-	app.Initialize(s.Addr(), "")
+	app := &App{logger: logging.New(io.Discard, slog.LevelInfo)}
+	redisConfig := config.Default().Redis
+	redisConfig.URL = s.Addr()
+	if err := app.Initialize(redisConfig); err != nil {
+		panic(err)
+	}
 	return app
 }
 
@@ -29,6 +46,9 @@ func loadInitUserData(conn redis.Conn) error {
 	if _, err := conn.Do("HMSET", redis.Args{}.Add("user:2").AddFlat(user2)...); err != nil {
 		return err
 	}
+	if _, err := conn.Do("ZADD", "users:ids", 1, 1, 2, 2); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -60,6 +80,7 @@ func TestGetUsersInternalServerError(t *testing.T) {
 	}
 	conn := app.pool.Get()
 	conn.Do("SET", "user:1", "invalid data type")
+	conn.Do("ZADD", "users:ids", 1, 1)
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(app.getUsers)
@@ -89,7 +110,136 @@ func TestGetUsersSuccess(t *testing.T) {
 	if rr.Code != http.StatusOK {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
 	}
-	expected := `[{"id":1,"name":"John","age":31,"city":"New York"},{"id":2,"name":"Doe","age":22,"city":"Vancouver"}]`
+	expected := `{"items":[{"id":1,"name":"John","age":31,"city":"New York"},{"id":2,"name":"Doe","age":22,"city":"Vancouver"}]}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestGetUsersPagination(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/users?limit=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	var page UserList
+	if err := json.Unmarshal(rr.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != 1 || page.NextCursor == "" {
+		t.Fatalf("first page: got %v", rr.Body.String())
+	}
+	expectedLink := `</users?cursor=` + page.NextCursor + `&limit=1>; rel="next"`
+	if link := rr.Header().Get("Link"); link != expectedLink {
+		t.Errorf("Link header: got %v, expected %v", link, expectedLink)
+	}
+
+	req, err = http.NewRequest("GET", "/users?limit=1&cursor="+page.NextCursor, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	expected := `{"items":[{"id":2,"name":"Doe","age":22,"city":"Vancouver"}]}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+	if link := rr.Header().Get("Link"); link != "" {
+		t.Errorf("Link header: got %v, expected none on the last page", link)
+	}
+}
+
+func TestGetUsersEmpty(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("GET", "/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	expected := `{"items":[]}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestGetUsersBadRequest(t *testing.T) {
+	app := setup()
+	for _, query := range []string{"limit=0", "limit=abc", "limit=1000", "cursor=!!", "min_age=-1", "max_age=old", "sort=email", "country=CA", "sort=age&cursor=MQ", "cursor=b2Zmc2V0OjE"} {
+		req, err := http.NewRequest("GET", "/users?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: http status code: got %v, expected %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetUsersFiltered(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.IndexExistingUsers(conn); err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"city=vancouver":            `{"items":[{"id":2,"name":"Doe","age":22,"city":"Vancouver"}]}`,
+		"min_age=25&max_age=40":     `{"items":[{"id":1,"name":"John","age":31,"city":"New York"}]}`,
+		"name_prefix=jo":            `{"items":[{"id":1,"name":"John","age":31,"city":"New York"}]}`,
+		"city=Paris":                `{"items":[]}`,
+		"sort=age":                  `{"items":[{"id":2,"name":"Doe","age":22,"city":"Vancouver"},{"id":1,"name":"John","age":31,"city":"New York"}]}`,
+		"sort=-name&name_prefix=do": `{"items":[{"id":2,"name":"Doe","age":22,"city":"Vancouver"}]}`,
+	}
+	for query, expected := range tests {
+		req, err := http.NewRequest("GET", "/users?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: http status code: got %v, expected %v", query, rr.Code, http.StatusOK)
+		}
+		if rr.Body.String() != expected {
+			t.Errorf("%s: response body: got %v, expected %v", query, rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestGetUsersUnknownFilter(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("GET", "/users?country=CA", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(app.getUsers)
+	handler.ServeHTTP(rr, req)
+
+	expected := `{"type":"/problems/invalid-request","title":"Invalid request","status":400,"detail":"unknown filter \"country\"","instance":"/users"}`
 	if rr.Body.String() != expected {
 		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
 	}
@@ -105,7 +255,7 @@ func TestCreateUserSuccess(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(app.createOrUpdateUser)
+	handler := http.HandlerFunc(app.createUser)
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusCreated {
@@ -125,15 +275,14 @@ func TestUpdateUserSuccess(t *testing.T) {
 		t.Fatal(err)
 	}
 	requestDataString := []byte(`{"id": 1, "name": "John", "age": 31, "city": "New York"}`)
-	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(app.createOrUpdateUser)
-	handler.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
@@ -159,7 +308,7 @@ func TestCreateOrUpdateUserBadRequest(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(app.createOrUpdateUser)
+	handler := http.HandlerFunc(app.createUser)
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusBadRequest {
@@ -179,7 +328,7 @@ func TestCreateOrUpdateUserInternalServerError(t *testing.T) {
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(app.createOrUpdateUser)
+	handler := http.HandlerFunc(app.createUser)
 	handler.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusInternalServerError {
@@ -190,15 +339,14 @@ func TestCreateOrUpdateUserInternalServerError(t *testing.T) {
 func TestUpdateUserNotFound(t *testing.T) {
 	app := setup()
 	requestDataString := []byte(`{"id": 1, "name": "John", "age": 31, "city": "New York"}`)
-	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(app.createOrUpdateUser)
-	handler.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
@@ -218,7 +366,7 @@ func TestGetUserByIDSuccess(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusOK {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
@@ -242,7 +390,7 @@ func TestGetUserByIDMissingID(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
@@ -262,7 +410,7 @@ func TestGetUserByIDNonIntegerID(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
@@ -280,14 +428,15 @@ func TestGetUserByIDNoUserFound(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("X-Request-ID", "test-request")
 
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusNotFound {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
 	}
-	expected := `{"error":"no user found"}`
+	expected := `{"type":"/problems/user-not-found","title":"User not found","status":404,"detail":"no user found","instance":"/user/124/","request_id":"test-request"}`
 	if rr.Body.String() != expected {
 		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
 	}
@@ -305,11 +454,17 @@ func TestGetUserByIDInternalServerError(t *testing.T) {
 	}
 
 	rr := httptest.NewRecorder()
-	app.Router.ServeHTTP(rr, req)
+	app.ServeHTTP(rr, req)
 
 	if rr.Code != http.StatusInternalServerError {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusInternalServerError)
 	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("Content-Type: got %v, expected application/problem+json", contentType)
+	}
+	if strings.Contains(rr.Body.String(), "WRONGTYPE") {
+		t.Errorf("response body: got %v, expected the Redis error to be masked", rr.Body.String())
+	}
 }
 
 func TestGetUserByIDInvalidID(t *testing.T) {
@@ -334,7 +489,922 @@ func TestGetUserByIDInvalidID(t *testing.T) {
 	if rr.Code != http.StatusBadRequest {
 		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusBadRequest)
 	}
-	expected := `{"error":"invalid userID"}`
+	expected := `{"type":"/problems/invalid-request","title":"Invalid request","status":400,"detail":"invalid userID","instance":"/user/"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestGetUserByIDMemoryStore(t *testing.T) {
+	app := &App{store: v1.NewMemoryUserStore(), Router: mux.NewRouter()}
+	app.setRoutes()
+	user := &v1.User{Name: "John", Age: 31, City: "New York"}
+	if err := app.store.CreateOrUpdateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/user/1/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	expected := `{"id":1,"name":"John","age":31,"city":"New York","created_at":"` + jsonTime(user.CreatedAt) + `","updated_at":"` + jsonTime(user.UpdatedAt) + `"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+// jsonTime is a timestamp of the store as it is rendered in JSON
+func jsonTime(ms int64) string {
+	return timeFromMillis(ms).Format(time.RFC3339Nano)
+}
+
+func TestDeleteUserSuccess(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("DELETE", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNoContent)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("response body: got %v, expected empty body", rr.Body.String())
+	}
+}
+
+func TestSoftDeleteUserSuccess(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("DELETE", "/user/1?soft=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNoContent)
+	}
+
+	req, err = http.NewRequest("GET", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestDeleteUserNotFound(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("DELETE", "/user/124", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+	expected := `{"type":"/problems/user-not-found","title":"User not found","status":404,"detail":"no user found","instance":"/user/124","request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestDeleteUserBadRequest(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("DELETE", "/user/1?soft=maybe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCreateUserWithID(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"id": 1, "name": "John", "age": 31, "city": "New York"}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestCreateUserTrailingData(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"name": "John", "age": 31} {"name": "Jane", "age": 30}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+	expected := `{"type":"/problems/invalid-request","title":"Invalid request","status":400,"detail":"the request body must hold a single JSON value","instance":"/users","request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+	if count, _ := redis.Int(app.pool.Get().Do("ZCARD", "users:ids")); count != 0 {
+		t.Errorf("users: got %v, expected none created", count)
+	}
+}
+
+func TestReplaceUserSuccess(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDataString := []byte(`{"name": "Johnny", "age": 32}`)
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	user, err := app.store.FindUserByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := v1.User{ID: 1, Name: "Johnny", Age: 32, Version: 2, UpdatedAt: user.UpdatedAt}
+	if user.UpdatedAt == 0 || !reflect.DeepEqual(*user, expected) {
+		t.Errorf("stored user: got %+v, expected %+v", *user, expected)
+	}
+}
+
+func TestReplaceUserIDMismatch(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDataString := []byte(`{"id": 2, "name": "John", "age": 31, "city": "New York"}`)
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPatchUserMergePatch(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDataString := []byte(`{"age": 32, "city": null}`)
+	req, err := http.NewRequest("PATCH", "/user/1", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	stored, err := app.store.FindUserByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"id":1,"name":"John","age":32,"city":"","updated_at":"` + jsonTime(stored.UpdatedAt) + `"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestPatchUserJSONPatch(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDataString := []byte(`[{"op": "test", "path": "/name", "value": "Doe"}, {"op": "replace", "path": "/city", "value": "Toronto"}]`)
+	req, err := http.NewRequest("PATCH", "/user/2", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json-patch+json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	stored, err := app.store.FindUserByID(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"id":2,"name":"Doe","age":22,"city":"Toronto","updated_at":"` + jsonTime(stored.UpdatedAt) + `"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestPatchUserBadRequest(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		contentType, patch string
+	}{
+		{"application/json-patch+json", `[{"op": "test", "path": "/name", "value": "John"}]`},
+		{"application/json-patch+json", `[{"op": "replace", "path": "/id", "value": 3}]`},
+		{"application/merge-patch+json", `{"age": 3`},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("PATCH", "/user/2", bytes.NewBufferString(test.patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", test.contentType)
+
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: http status code: got %v, expected %v", test.patch, rr.Code, http.StatusBadRequest)
+		}
+	}
+	user, err := app.store.FindUserByID(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Doe" || user.Age != 22 {
+		t.Errorf("stored user changed by a rejected patch: %+v", *user)
+	}
+}
+
+func TestPatchUserUnsupportedMediaType(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("PATCH", "/user/1", bytes.NewBufferString(`{"age": 32}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestWriteUserBodyTooLarge(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"name": "` + strings.Repeat("a", maxBodyBytes) + `"}`
+	for _, test := range []struct {
+		method, path, contentType string
+	}{
+		{"POST", "/users", "application/json"},
+		{"PUT", "/user/1", "application/json"},
+		{"PATCH", "/user/1", "application/merge-patch+json"},
+	} {
+		req, err := http.NewRequest(test.method, test.path, bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", test.contentType)
+
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s %s: http status code: got %v, expected %v", test.method, test.path, rr.Code, http.StatusRequestEntityTooLarge)
+		}
+		if !strings.Contains(rr.Body.String(), `"type":"/problems/body-too-large"`) {
+			t.Errorf("%s %s: response body: got %v, expected a body-too-large problem", test.method, test.path, rr.Body.String())
+		}
+	}
+}
+
+func TestPatchUserNotFound(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("PATCH", "/user/124", bytes.NewBufferString(`{"age": 32}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestCreateUserUnprocessableEntity(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"name": " ", "age": -1, "city": "` + strings.Repeat("x", 101) + `"}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	expected := `{"type":"/problems/validation-failed","title":"Validation failed","status":422,"detail":"validation failed: name: is required; age: must be between 0 and 150; city: must be at most 100 characters","instance":"/users","fields":[{"field":"name","message":"is required"},{"field":"age","message":"must be between 0 and 150"},{"field":"city","message":"must be at most 100 characters"}],"request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestCreateUserProfile(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"name": "John", "age": 31, "email": "john@example.com", "phone": "+1 212 555 0100", "attributes": {"team": "core"}, "created_at": "2000-01-01T00:00:00Z"}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("http status code: got %v, expected %v", rr.Code, http.StatusCreated)
+	}
+
+	req, _ = http.NewRequest("GET", rr.Header().Get("Location"), nil)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	var user User
+	if err := json.Unmarshal(rr.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "john@example.com" || user.Phone != "+1 212 555 0100" || user.Attributes["team"] != "core" {
+		t.Errorf("user: got %+v, expected the email, phone and attributes sent", user)
+	}
+	if user.CreatedAt == nil || user.CreatedAt.Year() == 2000 || user.UpdatedAt == nil || !user.UpdatedAt.Equal(*user.CreatedAt) {
+		t.Errorf("user timestamps: got %v, %v, expected both set by the server", user.CreatedAt, user.UpdatedAt)
+	}
+}
+
+func TestCreateUserDuplicateEmail(t *testing.T) {
+	app := setup()
+	for i, status := range []int{http.StatusCreated, http.StatusConflict} {
+		requestDataString := []byte(`{"name": "John", "email": "john@example.com"}`)
+		req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Request-ID", "test-request")
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != status {
+			t.Errorf("create %d: http status code: got %v, expected %v", i+1, rr.Code, status)
+		}
+		if status != http.StatusConflict {
+			continue
+		}
+		expected := `{"type":"/problems/email-taken","title":"Email already taken","status":409,"detail":"email is already taken","instance":"/users","request_id":"test-request"}`
+		if rr.Body.String() != expected {
+			t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+		}
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	app := setup()
+	user := &v1.User{Name: "John", Age: 31, City: "New York", Email: "john@example.com"}
+	if err := app.store.CreateOrUpdateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	expectedUser := `{"id":1,"name":"John","age":31,"city":"New York","email":"john@example.com","created_at":"` + jsonTime(user.CreatedAt) + `","updated_at":"` + jsonTime(user.UpdatedAt) + `"}`
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/user/by-email/John@example.com", http.StatusOK, expectedUser},
+		{"/users?email=john%40example.com", http.StatusOK, `{"items":[` + expectedUser + `]}`},
+		{"/users?email=jane%40example.com", http.StatusOK, `{"items":[]}`},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s: http status code: got %v, expected %v", test.path, rr.Code, test.status)
+		}
+		if rr.Body.String() != test.expected {
+			t.Errorf("%s: response body: got %v, expected %v", test.path, rr.Body.String(), test.expected)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/user/by-email/jane@example.com", nil)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+
+	//the email moving to another user at the same version is not a 304
+	if _, err := app.store.UpdateUser(context.Background(), user.ID, func(user *v1.User) error {
+		user.Email = "john@example.org"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	jane := &v1.User{Name: "Jane", Age: 28, Email: "john@example.com"}
+	if err := app.store.CreateOrUpdateUser(context.Background(), jane); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", "/user/by-email/john@example.com", nil)
+	req.Header.Set("If-None-Match", userETag(user.ID, jane.Version))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Header().Get("ETag") != userETag(jane.ID, jane.Version) {
+		t.Errorf("http status code and ETag: got %v %s, expected %v %s", rr.Code, rr.Header().Get("ETag"), http.StatusOK, userETag(jane.ID, jane.Version))
+	}
+}
+
+func TestCreateUserInvalidProfile(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"name": "John", "email": "john", "phone": "call me", "attributes": {"": "x", "team": "` + strings.Repeat("x", 1025) + `"}}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	expected := `"fields":[{"field":"email","message":"must be an email address"},{"field":"phone","message":"must be a phone number"},{"field":"attributes.","message":"is required"},{"field":"attributes.team","message":"must be at most 1024 characters"}]`
+	if !strings.Contains(rr.Body.String(), expected) {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestCreateUserUnknownField(t *testing.T) {
+	app := setup()
+	requestDataString := []byte(`{"name": "John", "age": 31, "country": "USA"}`)
+	req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusUnprocessableEntity)
+	}
+	expected := `{"type":"/problems/validation-failed","title":"Validation failed","status":422,"detail":"validation failed: country: is not a known field","instance":"/users","fields":[{"field":"country","message":"is not a known field"}],"request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestPatchUserUnprocessableEntity(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, patch := range []string{`{"age": "old"}`, `{"name": null}`, `{"nickname": "JD"}`} {
+		req, err := http.NewRequest("PATCH", "/user/1", bytes.NewBufferString(patch))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: http status code: got %v, expected %v", patch, rr.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+func TestCreateUserConcurrent(t *testing.T) {
+	app := setup()
+	const creates = 200
+	locations := make(chan string, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			requestDataString := []byte(`{"name": "John", "age": 31, "city": "New York"}`)
+			req, err := http.NewRequest("POST", "/users", bytes.NewBuffer(requestDataString))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+			app.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusCreated {
+				t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusCreated)
+				return
+			}
+			locations <- rr.Header().Get("Location")
+		}()
+	}
+	wg.Wait()
+	close(locations)
+
+	seen := make(map[string]bool)
+	for location := range locations {
+		if seen[location] {
+			t.Errorf("%s was created twice", location)
+		}
+		seen[location] = true
+	}
+	users, err := app.store.ListAllUsers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != creates {
+		t.Errorf("stored users: got %d, expected %d", len(users), creates)
+	}
+}
+
+func TestGetUserByIDETag(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if etag := rr.Header().Get("ETag"); etag != `"1-1"` {
+		t.Errorf("ETag: got %v, expected %v", etag, `"1-1"`)
+	}
+
+	req.Header.Set("If-None-Match", `"1-1"`)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNotModified)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("response body: got %v, expected empty body", rr.Body.String())
+	}
+}
+
+func TestUpdateUserIfMatch(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestDataString := []byte(`{"name": "John", "age": 32, "city": "New York"}`)
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", `"1-1"`)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if etag := rr.Header().Get("ETag"); etag != `"1-2"` {
+		t.Errorf("ETag: got %v, expected %v", etag, `"1-2"`)
+	}
+
+	//a client still holding version 1 loses the race
+	req, err = http.NewRequest("PATCH", "/user/1", bytes.NewBufferString(`{"city": "Boston"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", `"1-1"`)
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusPreconditionFailed)
+	}
+
+	req.Header.Set("If-Match", `"1-2"`)
+	req.Body = io.NopCloser(bytes.NewBufferString(`{"city": "Boston"}`))
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if etag := rr.Header().Get("ETag"); etag != `"1-3"` {
+		t.Errorf("ETag: got %v, expected %v", etag, `"1-3"`)
+	}
+}
+
+func TestReplaceUserPreconditionFailed(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestDataString := []byte(`{"name": "John", "age": 32, "city": "New York"}`)
+	req, err := http.NewRequest("PUT", "/user/1", bytes.NewBuffer(requestDataString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", `"1-7"`)
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusPreconditionFailed)
+	}
+	expected := `{"type":"/problems/version-mismatch","title":"User version does not match","status":412,"detail":"user version does not match","instance":"/user/1","request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestDeleteUserPreconditionFailed(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("DELETE", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", `"1-2"`)
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusPreconditionFailed)
+	}
+	if _, err := app.store.FindUserByID(context.Background(), 1); err != nil {
+		t.Errorf("user deleted despite a failed precondition: %v", err)
+	}
+}
+
+func TestIfMatchAnyMissingUser(t *testing.T) {
+	app := setup()
+	requests := map[string]string{
+		"PUT":    `{"name": "John", "age": 31}`,
+		"PATCH":  `{"age": 32}`,
+		"DELETE": "",
+	}
+	for method, body := range requests {
+		req, err := http.NewRequest(method, "/user/124", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		req.Header.Set("If-Match", "*")
+
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: http status code: got %v, expected %v", method, rr.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
+
+func TestDeleteUserIfMatchList(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	err := loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("DELETE", "/user/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-Match", `"1-2", "1-1"`)
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusNoContent)
+	}
+	if _, err := app.store.FindUserByID(context.Background(), 1); err != v1.ErrNoUserFound {
+		t.Errorf("user not deleted: got %v, expected %v", err, v1.ErrNoUserFound)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.IndexExistingUsers(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/users/search?q=joh", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	var results SearchResultList
+	if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Items) != 1 || results.Items[0].User.ID != 1 || results.Items[0].Highlights["name"] != "<em>Joh</em>n" {
+		t.Errorf("response body: got %v, expected John with its name highlighted", rr.Body.String())
+	}
+
+	for _, query := range []string{"", "q=", "q=john&limit=0", "q=john&city=Vancouver"} {
+		req, err := http.NewRequest("GET", "/users/search?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: http status code: got %v, expected %v", query, rr.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestGetUserStats(t *testing.T) {
+	app := setup()
+	req, err := http.NewRequest("GET", "/users/stats", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	expected := `{"total":0,"cities":{}}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+
+	conn := app.pool.Get()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := v1.IndexExistingUsers(conn); err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	expected = `{"total":2,"cities":{"new york":1,"vancouver":1},"age":{"min":22,"max":31,"mean":26.5,"histogram":[{"min":20,"max":29,"count":1},{"min":30,"max":39,"count":1}]}}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+// conflictingStore changes the user from another connection every time an
+// update is attempted, so every transaction of the update is aborted
+type conflictingStore struct {
+	v1.UserStore
+	pool *redis.Pool
+}
+
+func (s conflictingStore) UpdateUser(ctx context.Context, userID int, fn func(user *v1.User) error) (*v1.User, error) {
+	return s.UserStore.UpdateUser(ctx, userID, func(user *v1.User) error {
+		conn := s.pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("HINCRBY", "user:"+strconv.Itoa(userID), "age", 1); err != nil {
+			return err
+		}
+		return fn(user)
+	})
+}
+
+func TestPatchUserTooManyConflicts(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	defer conn.Close()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	app.store = conflictingStore{UserStore: app.store, pool: app.pool}
+	req, err := http.NewRequest("PATCH", "/user/1", bytes.NewBufferString(`{"city": "Boston"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("X-Request-ID", "test-request")
+
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusConflict)
+	}
+	expected := `{"type":"/problems/write-conflict","title":"Too many concurrent writes","status":409,"detail":"too many concurrent writes, try again","instance":"/user/1","request_id":"test-request"}`
 	if rr.Body.String() != expected {
 		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
 	}
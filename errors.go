@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/rnidev/go-rest/pkg/auth"
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/problem"
+	"github.com/rnidev/go-rest/pkg/requestid"
+	v1 "github.com/rnidev/go-rest/pkg/service/v1"
+	"github.com/rnidev/go-rest/pkg/validation"
+)
+
+// The problem types of the API, their URIs are relative to the API
+var (
+	problemInvalidRequest   = problem.Type{URI: "/problems/invalid-request", Title: "Invalid request", Status: http.StatusBadRequest}
+	problemUnauthorized     = problem.Type{URI: "/problems/unauthorized", Title: "Authentication required", Status: http.StatusUnauthorized}
+	problemForbidden        = problem.Type{URI: "/problems/forbidden", Title: "Forbidden", Status: http.StatusForbidden}
+	problemUserNotFound     = problem.Type{URI: "/problems/user-not-found", Title: "User not found", Status: http.StatusNotFound}
+	problemEmailTaken       = problem.Type{URI: "/problems/email-taken", Title: "Email already taken", Status: http.StatusConflict}
+	problemWriteConflict    = problem.Type{URI: "/problems/write-conflict", Title: "Too many concurrent writes", Status: http.StatusConflict}
+	problemVersionMismatch  = problem.Type{URI: "/problems/version-mismatch", Title: "User version does not match", Status: http.StatusPreconditionFailed}
+	problemUnsupportedPatch = problem.Type{URI: "/problems/unsupported-patch", Title: "Unsupported patch format", Status: http.StatusUnsupportedMediaType}
+	problemBodyTooLarge     = problem.Type{URI: "/problems/body-too-large", Title: "Request body too large", Status: http.StatusRequestEntityTooLarge}
+	problemValidation       = problem.Type{URI: "/problems/validation-failed", Title: "Validation failed", Status: http.StatusUnprocessableEntity}
+	problemRateLimited      = problem.Type{URI: "/problems/rate-limited", Title: "Rate limit exceeded", Status: http.StatusTooManyRequests}
+	problemInternal         = problem.Type{URI: "/problems/internal", Title: "Internal server error", Status: http.StatusInternalServerError}
+)
+
+// errorProblems maps the errors that can be shown to clients to their problem
+// type, every other error is internal
+var errorProblems = []struct {
+	err     error
+	problem problem.Type
+}{
+	{ErrIDRequired, problemInvalidRequest},
+	{ErrInvalidUserID, problemInvalidRequest},
+	{ErrInvalidLimit, problemInvalidRequest},
+	{ErrInvalidSoft, problemInvalidRequest},
+	{ErrInvalidMinAge, problemInvalidRequest},
+	{ErrInvalidMaxAge, problemInvalidRequest},
+	{ErrUnknownFilter, problemInvalidRequest},
+	{ErrQueryRequired, problemInvalidRequest},
+	{ErrIDNotAllowed, problemInvalidRequest},
+	{ErrIDMismatch, problemInvalidRequest},
+	{v1.ErrInvalidCursor, problemInvalidRequest},
+	{v1.ErrInvalidSort, problemInvalidRequest},
+	{auth.ErrNoCredentials, problemUnauthorized},
+	{auth.ErrInvalidCredentials, problemUnauthorized},
+	{auth.ErrForbidden, problemForbidden},
+	{v1.ErrNoUserFound, problemUserNotFound},
+	{v1.ErrEmailTaken, problemEmailTaken},
+	{v1.ErrVersionMismatch, problemVersionMismatch},
+	{v1.ErrTooManyConflicts, problemWriteConflict},
+	{ErrUnsupportedPatch, problemUnsupportedPatch},
+	{ErrBodyTooLarge, problemBodyTooLarge},
+	{ErrRateLimited, problemRateLimited},
+}
+
+// problemType finds the type of err, which may wrap a mapped error with the
+// details clients need
+func problemType(err error) (problem.Type, bool) {
+	for _, mapped := range errorProblems {
+		if errors.Is(err, mapped.err) {
+			return mapped.problem, true
+		}
+	}
+	return problem.Type{}, false
+}
+
+// renderErrorResp reports err as a problem of its type. Internal errors are
+// logged with the request, and masked behind a 500 Internal Server Error so
+// the details of the storage never reach clients.
+func renderErrorResp(w http.ResponseWriter, r *http.Request, err error) {
+	if typ, ok := problemType(err); ok {
+		renderProblem(w, r, typ.New(err.Error(), r.URL.Path))
+		return
+	}
+	logging.FromContext(r.Context()).Error("request failed", slog.String("error", err.Error()))
+	renderProblem(w, r, problemInternal.New("the request could not be completed, quote the request_id when reporting it", r.URL.Path))
+}
+
+// renderRequestErrorResp reports a payload that could not be decoded or
+// validated, listing every field error with 422 Unprocessable Entity, or that
+// was cut off at maxBodyBytes with 413 Request Entity Too Large
+func renderRequestErrorResp(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		err = fmt.Errorf("%w, the limit is %d bytes", ErrBodyTooLarge, tooLarge.Limit)
+	}
+	if fieldErrs, ok := err.(validation.Errors); ok {
+		renderProblem(w, r, problemValidation.New(err.Error(), r.URL.Path).With("fields", fieldErrs))
+		return
+	}
+	if _, ok := problemType(err); ok {
+		renderErrorResp(w, r, err)
+		return
+	}
+	renderProblem(w, r, problemInvalidRequest.New(err.Error(), r.URL.Path))
+}
+
+// renderProblem writes p with the ID of the request, so clients can quote it
+// when reporting a failure
+func renderProblem(w http.ResponseWriter, r *http.Request, p *problem.Problem) {
+	if id := w.Header().Get(requestid.Header); id != "" {
+		p.With("request_id", id)
+	}
+	p.Write(w)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rnidev/go-rest/pkg/logging"
+	v1 "github.com/rnidev/go-rest/pkg/service/v1"
+)
+
+func TestRenderErrorResp(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		typ    string
+		detail string
+	}{
+		{v1.ErrNoUserFound, http.StatusNotFound, "/problems/user-not-found", "no user found"},
+		{ErrInvalidLimit, http.StatusBadRequest, "/problems/invalid-request", "invalid limit"},
+		{v1.ErrVersionMismatch, http.StatusPreconditionFailed, "/problems/version-mismatch", "user version does not match"},
+		{errors.New("WRONGTYPE Operation against a key holding the wrong kind of value"), http.StatusInternalServerError, "/problems/internal", ""},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		req, _ := http.NewRequest("GET", "/user/1", nil)
+		req = req.WithContext(logging.NewContext(req.Context(), logging.New(&out, slog.LevelInfo)))
+		rr := httptest.NewRecorder()
+		renderErrorResp(rr, req, test.err)
+
+		if rr.Code != test.status {
+			t.Errorf("%v: http status code: got %v, expected %v", test.err, rr.Code, test.status)
+		}
+		body := rr.Body.String()
+		if !strings.Contains(body, `"type":"`+test.typ+`"`) || !strings.Contains(body, `"instance":"/user/1"`) {
+			t.Errorf("%v: response body: got %v, expected a %s problem", test.err, body, test.typ)
+		}
+		if test.status < http.StatusInternalServerError {
+			if !strings.Contains(body, `"detail":"`+test.detail+`"`) {
+				t.Errorf("%v: response body: got %v, expected detail %q", test.err, body, test.detail)
+			}
+			if out.Len() != 0 {
+				t.Errorf("%v: logged %s, expected nothing", test.err, out.String())
+			}
+			continue
+		}
+		if strings.Contains(body, "WRONGTYPE") {
+			t.Errorf("response body: got %v, expected the error to be masked", body)
+		}
+		if !strings.Contains(out.String(), "WRONGTYPE") {
+			t.Errorf("log: got %q, expected the internal error", out.String())
+		}
+	}
+}
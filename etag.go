@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	v1 "github.com/rnidev/go-rest/pkg/service/v1"
+)
+
+// userETag is the strong entity tag of a user, derived from its ID and version
+// so users found by another route than their ID never share one
+func userETag(userID, version int) string {
+	return `"` + strconv.Itoa(userID) + "-" + strconv.Itoa(version) + `"`
+}
+
+// ifMatch is the If-Match precondition of a request: whether the header was
+// sent, and the versions of the user its ETags name, none for "*"
+type ifMatch struct {
+	present  bool
+	versions []int
+}
+
+// parseIfMatch reads the If-Match header, a list of ETags or "*". Only ETags
+// previously returned by this API for that user can match, a header where no
+// ETag can match is reported as v1.ErrVersionMismatch
+func parseIfMatch(r *http.Request, userID int) (ifMatch, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		return ifMatch{}, nil
+	}
+	if header == "*" {
+		return ifMatch{present: true}, nil
+	}
+	precondition := ifMatch{present: true}
+	for _, candidate := range strings.Split(header, ",") {
+		if version, ok := etagVersion(strings.TrimSpace(candidate), userID); ok {
+			precondition.versions = append(precondition.versions, version)
+		}
+	}
+	if len(precondition.versions) == 0 {
+		return ifMatch{}, v1.ErrVersionMismatch
+	}
+	return precondition, nil
+}
+
+// etagVersion returns the version named by a strong ETag of the user
+func etagVersion(etag string, userID int) (int, bool) {
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+	id, version, ok := strings.Cut(etag[1:len(etag)-1], "-")
+	if !ok || id != strconv.Itoa(userID) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(version)
+	if err != nil || n < 1 {
+		return 0, false
+	}
+	return n, true
+}
+
+// check fails with v1.ErrVersionMismatch unless the user at version matches
+func (m ifMatch) check(version int) error {
+	if len(m.versions) == 0 {
+		return nil
+	}
+	for _, v := range m.versions {
+		if v == version {
+			return nil
+		}
+	}
+	return v1.ErrVersionMismatch
+}
+
+// storeError reports a missing user as v1.ErrVersionMismatch when the header
+// was sent, as no If-Match, not even "*", matches a user that does not exist
+func (m ifMatch) storeError(err error) error {
+	if m.present && errors.Is(err, v1.ErrNoUserFound) {
+		return v1.ErrVersionMismatch
+	}
+	return err
+}
+
+// ifNoneMatch reports whether the If-None-Match header matches the given ETag,
+// using the weak comparison RFC 7232 requires for this header
+func ifNoneMatch(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	v1 "github.com/rnidev/go-rest/pkg/service/v1"
+)
+
+func TestParseIfMatch(t *testing.T) {
+	tests := []struct {
+		header   string
+		present  bool
+		versions []int
+		err      error
+	}{
+		{"", false, nil, nil},
+		{"*", true, nil, nil},
+		{`"1-3"`, true, []int{3}, nil},
+		{`"2-3"`, false, nil, v1.ErrVersionMismatch},
+		{`"3"`, false, nil, v1.ErrVersionMismatch},
+		{`W/"1-3"`, false, nil, v1.ErrVersionMismatch},
+		{`"1-3", "1-4"`, true, []int{3, 4}, nil},
+		{`"2-3","1-4" , W/"1-5"`, true, []int{4}, nil},
+		{`"1-0"`, false, nil, v1.ErrVersionMismatch},
+		{`1-3`, false, nil, v1.ErrVersionMismatch},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "/user/1", nil)
+		req.Header.Set("If-Match", test.header)
+		precondition, err := parseIfMatch(req, 1)
+		if precondition.present != test.present || !reflect.DeepEqual(precondition.versions, test.versions) || err != test.err {
+			t.Errorf("parseIfMatch(%s) = %+v, %v, expect %v, %v, %v", test.header, precondition, err, test.present, test.versions, test.err)
+		}
+	}
+}
+
+func TestIfMatchCheck(t *testing.T) {
+	req, _ := http.NewRequest("PUT", "/user/1", nil)
+	req.Header.Set("If-Match", `"1-3", "1-4"`)
+	precondition, _ := parseIfMatch(req, 1)
+	for version, expect := range map[int]error{2: v1.ErrVersionMismatch, 3: nil, 4: nil, 5: v1.ErrVersionMismatch} {
+		if err := precondition.check(version); err != expect {
+			t.Errorf("check(%d) = %v, expect %v", version, err, expect)
+		}
+	}
+	if err := precondition.storeError(v1.ErrNoUserFound); err != v1.ErrVersionMismatch {
+		t.Errorf("storeError(ErrNoUserFound) = %v, expect %v", err, v1.ErrVersionMismatch)
+	}
+	if err := (ifMatch{}).storeError(v1.ErrNoUserFound); err != v1.ErrNoUserFound {
+		t.Errorf("without If-Match: storeError(ErrNoUserFound) = %v, expect %v", err, v1.ErrNoUserFound)
+	}
+}
+
+func TestIfNoneMatch(t *testing.T) {
+	tests := []struct {
+		header string
+		match  bool
+	}{
+		{"", false},
+		{"*", true},
+		{`"1-3"`, true},
+		{`W/"1-3"`, true},
+		{`"1-1", "1-3"`, true},
+		{`"1-4"`, false},
+		{`"2-3"`, false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/user/1", nil)
+		req.Header.Set("If-None-Match", test.header)
+		if match := ifNoneMatch(req, userETag(1, 3)); match != test.match {
+			t.Errorf("ifNoneMatch(%s) = %v, expect %v", test.header, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/logging"
+)
+
+var (
+	ErrSeedDataPending = errors.New("initial data is not loaded yet")
+	ErrShuttingDown    = errors.New("server is shutting down")
+	// ErrRedisUnavailable stands for the Redis errors in the public readiness
+	// report, which are logged instead as they may name hosts or credentials
+	ErrRedisUnavailable = errors.New("redis is unavailable")
+)
+
+// health tracks the state the readiness probe reports besides Redis itself
+type health struct {
+	seeded       atomic.Bool
+	shuttingDown atomic.Bool
+	pingTimeout  time.Duration
+}
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms,omitempty"`
+}
+
+func newCheckResult(err error) checkResult {
+	if err != nil {
+		return checkResult{Status: "fail", Error: err.Error()}
+	}
+	return checkResult{Status: "ok"}
+}
+
+// healthz reports that the process is alive and serving, it checks no
+// dependency so a Redis outage does not get the process restarted
+func (app *App) healthz(w http.ResponseWriter, r *http.Request) {
+	renderJSONResp(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz reports whether requests can be served: Redis answers a PING within
+// the ping timeout, the initial data is loaded and the server is not shutting
+// down. Every check is listed with its result, 503 when any fails.
+func (app *App) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]checkResult{
+		"redis": app.pingRedis(r.Context()),
+	}
+	if !app.health.seeded.Load() {
+		checks["seed_data"] = newCheckResult(ErrSeedDataPending)
+	} else {
+		checks["seed_data"] = newCheckResult(nil)
+	}
+	if app.health.shuttingDown.Load() {
+		checks["server"] = newCheckResult(ErrShuttingDown)
+	} else {
+		checks["server"] = newCheckResult(nil)
+	}
+
+	status, httpStatus := "ready", http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status, httpStatus = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	renderJSONResp(w, httpStatus, map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// pingRedis PINGs Redis through the pool within the ping timeout. Redigo does
+// not bound dialing, which may AUTH, or the PING of a borrowed connection by
+// ctx, so the check gives up at the timeout and leaves them to the timeouts of
+// the connection.
+func (app *App) pingRedis(ctx context.Context) checkResult {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, app.health.pingTimeout)
+	defer cancel()
+	pinged := make(chan error, 1)
+	go func() {
+		conn, err := app.pool.GetContext(ctx)
+		if err != nil {
+			pinged <- err
+			return
+		}
+		defer conn.Close()
+		remaining := time.Until(start.Add(app.health.pingTimeout))
+		_, err = redis.DoWithTimeout(conn, remaining, "PING")
+		pinged <- err
+	}()
+	var err error
+	select {
+	case err = <-pinged:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return app.redisUnavailable(ctx, err)
+	}
+	result := newCheckResult(nil)
+	result.LatencyMS = float64(time.Since(start)) / float64(time.Millisecond)
+	return result
+}
+
+// redisUnavailable logs why Redis failed the readiness check and reports it
+// failed without the detail
+func (app *App) redisUnavailable(ctx context.Context, err error) checkResult {
+	logging.FromContext(ctx).Warn("redis is not ready", slog.String("error", err.Error()))
+	return newCheckResult(ErrRedisUnavailable)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+func getReadiness(t *testing.T, app *App) (int, readiness) {
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	var body readiness
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("response body %s: %v", rr.Body.String(), err)
+	}
+	return rr.Code, body
+}
+
+func TestHealthz(t *testing.T) {
+	app := setup()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	expected := `{"status":"ok"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	app := setup()
+	code, body := getReadiness(t, app)
+	if code != http.StatusServiceUnavailable || body.Checks["seed_data"].Error != ErrSeedDataPending.Error() {
+		t.Errorf("before loadInitData(): got %v %+v, expected 503 with the seed data pending", code, body)
+	}
+
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	code, body = getReadiness(t, app)
+	if code != http.StatusOK || body.Status != "ready" {
+		t.Errorf("http status code: got %v %+v, expected %v and ready", code, body, http.StatusOK)
+	}
+	for _, name := range []string{"redis", "seed_data", "server"} {
+		if body.Checks[name].Status != "ok" {
+			t.Errorf("check %s: got %+v, expected ok", name, body.Checks[name])
+		}
+	}
+}
+
+func TestReadyzRedisDown(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisConfig := config.Default().Redis
+	redisConfig.URL = s.Addr()
+	redisConfig.PingTimeout = 100 * time.Millisecond
+	app := &App{}
+	if err := app.Initialize(redisConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer app.pool.Close()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	start := time.Now()
+	code, body := getReadiness(t, app)
+	if code != http.StatusServiceUnavailable || body.Status != "not ready" {
+		t.Errorf("http status code: got %v %+v, expected %v", code, body, http.StatusServiceUnavailable)
+	}
+	if body.Checks["redis"].Status != "fail" || body.Checks["redis"].Error != ErrRedisUnavailable.Error() {
+		t.Errorf("redis check: got %+v, expected a failure without the Redis error", body.Checks["redis"])
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readiness took %v, expected it bounded by the ping timeout", elapsed)
+	}
+}
+
+func TestReadyzDuringShutdown(t *testing.T) {
+	app := setup()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	app.Router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	cfg := config.Default().Server
+	cfg.ShutdownDrain = 0
+	go func() {
+		served <- app.serve(ctx, listener, cfg)
+	}()
+	go http.Get("http://" + listener.Addr().String() + "/slow")
+
+	<-started
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for !app.health.shuttingDown.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	code, body := getReadiness(t, app)
+	if code != http.StatusServiceUnavailable || body.Checks["server"].Error != ErrShuttingDown.Error() {
+		t.Errorf("while draining: got %v %+v, expected 503 shutting down", code, body)
+	}
+	close(release)
+	if err := <-served; err != nil {
+		t.Errorf("serve() error: got %s, expected no error", err.Error())
+	}
+}
+
+func TestReadyzDuringShutdownDrain(t *testing.T) {
+	app := setup()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + listener.Addr().String() + "/readyz"
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	cfg := config.Default().Server
+	cfg.ShutdownDrain = 300 * time.Millisecond
+	go func() {
+		served <- app.serve(ctx, listener, cfg)
+	}()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("before shutdown: got %v, expected %v", resp.StatusCode, http.StatusOK)
+	}
+
+	//the server still answers while draining, and reports it is not ready
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for !app.health.shuttingDown.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("while draining: got %v, expected /readyz to be served", err)
+	}
+	var body readiness
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || body.Checks["server"].Error != ErrShuttingDown.Error() {
+		t.Errorf("while draining: got %v %+v, expected 503 shutting down", resp.StatusCode, body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() error: got %s, expected no error", err.Error())
+	}
+	if _, err := http.Get(url); err == nil {
+		t.Errorf("server still accepts requests after the drain")
+	}
+}
+
+func TestReadyzRedisNeverReplies(t *testing.T) {
+	//the AUTH of the dial blocks
+	redisConfig := config.Default().Redis
+	redisConfig.URL = stalledRedis(t)
+	redisConfig.Password = "secret"
+	redisConfig.PingTimeout = 200 * time.Millisecond
+	app := &App{}
+	if err := app.Initialize(redisConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer app.pool.Close()
+
+	start := time.Now()
+	code, body := getReadiness(t, app)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("readiness took %v, expected it bounded by the ping timeout", elapsed)
+	}
+	if code != http.StatusServiceUnavailable || body.Checks["redis"].Error != ErrRedisUnavailable.Error() {
+		t.Errorf("redis check: got %v %+v, expected 503 with redis unavailable", code, body)
+	}
+}
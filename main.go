@@ -1,146 +1,614 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
 	"github.com/gorilla/mux"
+	"github.com/rnidev/go-rest/pkg/auth"
+	"github.com/rnidev/go-rest/pkg/config"
+	"github.com/rnidev/go-rest/pkg/jsonpatch"
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/ratelimit"
 	v1 "github.com/rnidev/go-rest/pkg/service/v1"
+	"github.com/rnidev/go-rest/pkg/tracing"
+	"github.com/rnidev/go-rest/pkg/validation"
 )
 
 type App struct {
-	pool   *redis.Pool
-	Router *mux.Router
+	pool    *redis.Pool
+	store   v1.UserStore
+	logger  *slog.Logger
+	metrics *appMetrics
+	health  health
+	auth    *auth.Middleware
+
+	limiter    *ratelimit.Limiter
+	rateLimits config.RateLimitConfig
+	Router     *mux.Router
+	//handler wraps Router in the middlewares every request goes through
+	handler http.Handler
 }
 
 type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
-	Age  int    `json:"age"`
-	City string `json:"city"`
+	ID         int               `json:"id"`
+	Name       string            `json:"name"`
+	Age        int               `json:"age"`
+	City       string            `json:"city"`
+	Email      string            `json:"email,omitempty"`
+	Phone      string            `json:"phone,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// CreatedAt and UpdatedAt are set by the store, they are ignored in payloads
+	// and left out for users stored before they existed
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+const (
+	maxUserAge        = 150
+	maxUserNameLength = 100
+	maxUserCityLength = 100
+
+	maxUserEmailLength        = 254
+	maxUserAttributes         = 50
+	maxUserAttributeKeyLength = 64
+	maxUserAttributeLength    = 1024
+)
+
+func (user *User) Validate() error {
+	var errs validation.Errors
+	errs.Required("name", user.Name)
+	errs.MaxLength("name", user.Name, maxUserNameLength)
+	errs.Range("age", user.Age, 0, maxUserAge)
+	errs.MaxLength("city", user.City, maxUserCityLength)
+	errs.MaxLength("email", user.Email, maxUserEmailLength)
+	errs.Email("email", user.Email)
+	errs.Phone("phone", user.Phone)
+	if len(user.Attributes) > maxUserAttributes {
+		errs.Add("attributes", fmt.Sprintf("must have at most %d attributes", maxUserAttributes))
+	}
+	keys := make([]string, 0, len(user.Attributes))
+	for key := range user.Attributes {
+		keys = append(keys, key)
+	}
+	// sorted so the field errors come in the same order on every request
+	sort.Strings(keys)
+	for _, key := range keys {
+		errs.Required("attributes."+key, key)
+		errs.MaxLength("attributes."+key, key, maxUserAttributeKeyLength)
+		errs.MaxLength("attributes."+key, user.Attributes[key], maxUserAttributeLength)
+	}
+	return errs.Err()
+}
+
+func userFromData(userData *v1.User) User {
+	var user User
+	user.ID = userData.ID
+	user.Name = userData.Name
+	user.Age = userData.Age
+	user.City = userData.City
+	user.Email = userData.Email
+	user.Phone = userData.Phone
+	user.Attributes = userData.Attributes
+	user.CreatedAt = timeFromMillis(userData.CreatedAt)
+	user.UpdatedAt = timeFromMillis(userData.UpdatedAt)
+	return user
+}
+
+func (user User) data() *v1.User {
+	var userData v1.User
+	userData.ID = user.ID
+	userData.Name = user.Name
+	userData.Age = user.Age
+	userData.City = user.City
+	userData.Email = user.Email
+	userData.Phone = user.Phone
+	userData.Attributes = user.Attributes
+	return &userData
+}
+
+// timeFromMillis converts a timestamp of the store, 0 being unknown
+func timeFromMillis(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	return &t
 }
 
 var (
 	ErrIDRequired    = errors.New("id is required")
 	ErrInvalidUserID = errors.New("invalid userID")
+	ErrInvalidLimit  = errors.New("invalid limit")
+	ErrInvalidSoft   = errors.New("invalid soft")
+	ErrInvalidMinAge = errors.New("invalid min_age")
+	ErrInvalidMaxAge = errors.New("invalid max_age")
+	ErrUnknownFilter = errors.New("unknown filter")
+	ErrQueryRequired = errors.New("q is required")
+	ErrIDNotAllowed  = errors.New("id is not allowed when creating a user")
+	ErrIDMismatch    = errors.New("id does not match the user being updated")
+
+	ErrUnsupportedPatch = errors.New("patch must be " + jsonpatch.MergePatchContentType + " or " + jsonpatch.JSONPatchContentType)
+	ErrBodyTooLarge     = errors.New("request body is too large")
 )
 
-func (app *App) Initialize(redisURL, redisPassword string) {
-	app.pool = &redis.Pool{
-		MaxIdle:     10,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", redisURL, redis.DialPassword(redisPassword))
-		},
+// maxBodyBytes bounds the bodies of the requests that write users
+const maxBodyBytes = 1 << 20
+
+func (app *App) Initialize(redisConfig config.RedisConfig) error {
+	pool, err := newPool(redisConfig)
+	if err != nil {
+		return err
+	}
+	app.pool = pool
+	app.health.pingTimeout = redisConfig.PingTimeout
+	if app.logger == nil {
+		app.logger = slog.Default()
 	}
+	app.metrics = app.newAppMetrics()
+	store := v1.NewRedisUserStore(app.pool)
+	store.ObserveCommands(app.metrics.observeRedisCommand)
+	app.store = store
 	app.Router = mux.NewRouter()
+	app.Router.Use(app.recordRoute)
+	app.handler = app.trackRoutes(app.tagRequests(app.traceRequests(app.logRequests(app.measureRequests(app.Router)))))
+	app.Router.Handle("/metrics", app.metrics.registry.Handler()).Methods("GET")
+	app.Router.HandleFunc("/healthz", app.healthz).Methods("GET")
+	app.Router.HandleFunc("/readyz", app.readyz).Methods("GET")
 	app.setRoutes()
+	return nil
+}
+
+// seedUsers are stored by loadInitData under their IDs the first time it runs
+// on a database, unless a user is stored there already
+var seedUsers = []v1.User{
+	{ID: 1, Name: "John", Age: 31, City: "New York"},
+	{ID: 2, Name: "Doe", Age: 22, City: "Vancouver"},
+}
+
+// ServeHTTP serves r through the request middlewares and the router, requests
+// matching no route included. An App set up without Initialize has no
+// middlewares and only serves its Router.
+func (app *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if app.handler == nil {
+		app.Router.ServeHTTP(w, r)
+		return
+	}
+	app.handler.ServeHTTP(w, r)
 }
 
-func (app *App) loadInitData(conn redis.Conn) error {
-	user1 := map[string]string{"id": "1", "name": "John", "age": "31", "city": "New York"}
-	user2 := map[string]string{"id": "2", "name": "Doe", "age": "22", "city": "Vancouver"}
-	if _, err := conn.Do("HMSET", redis.Args{}.Add("user:1").AddFlat(user1)...); err != nil {
+func (app *App) loadInitData() error {
+	conn := app.pool.Get()
+	defer conn.Close()
+	//users written before the indexes existed are indexed first
+	if err := v1.IndexExistingUsers(conn); err != nil {
 		return err
 	}
-	if _, err := conn.Do("HMSET", redis.Args{}.Add("user:2").AddFlat(user2)...); err != nil {
+	if _, err := v1.SeedUsers(conn, seedUsers); err != nil {
 		return err
 	}
+	app.health.seeded.Store(true)
 	return nil
 }
 
+// setRoutes registers the user routes with the role each one requires when
+// authentication is enabled
 func (app *App) setRoutes() {
 	app.Router.HandleFunc("/", app.rootHandler)
-	app.Router.StrictSlash(true).PathPrefix("/users").HandlerFunc(app.getUsers).Methods("GET")
-	app.Router.StrictSlash(true).PathPrefix("/users").HandlerFunc(app.createOrUpdateUser).Methods("POST")
-	app.Router.StrictSlash(true).PathPrefix("/user/{id:[0-9]+}").HandlerFunc(app.getUserByID).Methods("GET")
-}
-
-func (app *App) startServer(port string) {
-	fmt.Printf("Listening on port :%s", port)
-	http.ListenAndServe(":"+port, app.Router)
+	users := app.Router.NewRoute().Subrouter()
+	//the IP is limited first so rejected credentials are counted too
+	users.Use(app.rateLimitIP, app.authenticate, app.rateLimit)
+	//registered before the /users prefix, which would match them too
+	users.Path("/users/search").Handler(app.require(auth.RoleReader, app.searchUsers)).Methods("GET")
+	users.Path("/users/stats").Handler(app.require(auth.RoleReader, app.getUserStats)).Methods("GET")
+	users.StrictSlash(true).PathPrefix("/users").Handler(app.require(auth.RoleReader, app.getUsers)).Methods("GET")
+	users.StrictSlash(true).PathPrefix("/users").Handler(app.require(auth.RoleWriter, app.createUser)).Methods("POST")
+	users.Path("/user/by-email/{email}").Handler(app.require(auth.RoleReader, app.getUserByEmail)).Methods("GET")
+	users.StrictSlash(true).PathPrefix("/user/{id:[0-9]+}").Handler(app.require(auth.RoleReader, app.getUserByID)).Methods("GET")
+	users.StrictSlash(true).PathPrefix("/user/{id:[0-9]+}").Handler(app.require(auth.RoleWriter, app.replaceUser)).Methods("PUT")
+	users.StrictSlash(true).PathPrefix("/user/{id:[0-9]+}").Handler(app.require(auth.RoleWriter, app.patchUser)).Methods("PATCH")
+	users.StrictSlash(true).PathPrefix("/user/{id:[0-9]+}").Handler(app.require(auth.RoleAdmin, app.deleteUser)).Methods("DELETE")
 }
 
 func (app *App) rootHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "<h1>Hello World</h1><div>My name is Rui Ni</div>")
 }
-func (app *App) createOrUpdateUser(w http.ResponseWriter, r *http.Request) {
+func (app *App) createUser(w http.ResponseWriter, r *http.Request) {
 	var user User
-	var userData v1.User
-	err := json.NewDecoder(r.Body).Decode(&user)
+	err := validation.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), &user)
 	if err != nil {
-		renderJSONErrorResp(w, http.StatusBadRequest, err)
+		renderRequestErrorResp(w, r, err)
 		return
 	}
-	userData.ID = user.ID
-	userData.Name = user.Name
-	userData.Age = user.Age
-	userData.City = user.City
-	conn := app.pool.Get()
-	err = v1.CreateOrUpdateUser(conn, &userData)
-	if err == v1.ErrNoUserFound {
-		renderJSONErrorResp(w, http.StatusNotFound, err)
+	if user.ID != 0 {
+		renderErrorResp(w, r, ErrIDNotAllowed)
+		return
+	}
+	userData := user.data()
+	err = app.store.CreateOrUpdateUser(r.Context(), userData)
+	if err != nil {
+		renderErrorResp(w, r, err)
 		return
 	}
+	w.Header().Set("Location", "/user/"+strconv.Itoa(userData.ID))
+	w.Header().Set("ETag", userETag(userData.ID, userData.Version))
+	renderJSONResp(w, http.StatusCreated, map[string]string{"message": "user created successfully"})
+}
+
+func (app *App) replaceUser(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
 	if err != nil {
-		renderJSONErrorResp(w, http.StatusInternalServerError, err)
+		renderErrorResp(w, r, ErrInvalidUserID)
 		return
 	}
-	if user.ID > 0 {
-		renderJSONResp(w, http.StatusOK, map[string]string{"message": "user updated successfully"})
-	} else {
-		renderJSONResp(w, http.StatusCreated, map[string]string{"message": "user created successfully"})
+	var user User
+	err = validation.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), &user)
+	if err != nil {
+		renderRequestErrorResp(w, r, err)
+		return
+	}
+	if user.ID != 0 && user.ID != userID {
+		renderErrorResp(w, r, ErrIDMismatch)
+		return
+	}
+	user.ID = userID
+	precondition, err := parseIfMatch(r, userID)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
 	}
+	userData, err := app.store.UpdateUser(r.Context(), userID, func(current *v1.User) error {
+		if err := precondition.check(current.Version); err != nil {
+			return err
+		}
+		*current = *user.data()
+		return nil
+	})
+	if err != nil {
+		renderErrorResp(w, r, precondition.storeError(err))
+		return
+	}
+	w.Header().Set("ETag", userETag(userData.ID, userData.Version))
+	renderJSONResp(w, http.StatusOK, map[string]string{"message": "user updated successfully"})
 }
 
-func (app *App) getUsers(w http.ResponseWriter, r *http.Request) {
-	conn := app.pool.Get()
-	usersData, err := v1.ListAllUsers(conn)
+// patchUser applies a JSON Merge Patch or a JSON Patch, chosen by Content-Type,
+// to the JSON representation of the user and saves the fields it changed
+func (app *App) patchUser(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		renderErrorResp(w, r, ErrInvalidUserID)
+		return
+	}
+	var apply func(doc, patch []byte) ([]byte, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case jsonpatch.MergePatchContentType:
+		apply = jsonpatch.MergePatch
+	case jsonpatch.JSONPatchContentType:
+		apply = jsonpatch.Apply
+	default:
+		renderErrorResp(w, r, ErrUnsupportedPatch)
+		return
+	}
+	precondition, err := parseIfMatch(r, userID)
 	if err != nil {
-		renderJSONErrorResp(w, http.StatusInternalServerError, err)
+		renderErrorResp(w, r, err)
 		return
 	}
-	var users []User
-	for _, userData := range usersData {
+	patch, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		renderRequestErrorResp(w, r, err)
+		return
+	}
+	//patchErr keeps errors caused by the patch itself apart from storage errors
+	var patchErr error
+	userData, err := app.store.UpdateUser(r.Context(), userID, func(userData *v1.User) error {
+		if err := precondition.check(userData.Version); err != nil {
+			return err
+		}
+		doc, err := json.Marshal(userFromData(userData))
+		if err != nil {
+			return err
+		}
+		if doc, patchErr = apply(doc, patch); patchErr != nil {
+			return patchErr
+		}
 		var user User
-		user.ID = userData.ID
-		user.Name = userData.Name
-		user.Age = userData.Age
-		user.City = userData.City
-		users = append(users, user)
+		if patchErr = validation.DecodeJSON(bytes.NewReader(doc), &user); patchErr != nil {
+			return patchErr
+		}
+		if user.ID != userID {
+			patchErr = ErrIDMismatch
+			return patchErr
+		}
+		*userData = *user.data()
+		return nil
+	})
+	if patchErr != nil {
+		renderRequestErrorResp(w, r, patchErr)
+		return
+	}
+	if err != nil {
+		renderErrorResp(w, r, precondition.storeError(err))
+		return
+	}
+	w.Header().Set("ETag", userETag(userData.ID, userData.Version))
+	renderJSONResp(w, http.StatusOK, userFromData(userData))
+}
+
+type UserList struct {
+	Items      []User `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// listParams are the query parameters of GET /users, any other is rejected
+var listParams = map[string]bool{
+	"limit": true, "cursor": true, "sort": true, "email": true,
+	"city": true, "min_age": true, "max_age": true, "name_prefix": true,
+}
+
+func (app *App) getUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts, err := listOptions(query)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	if email := query.Get("email"); email != "" {
+		app.getUsersByEmail(w, r, email, opts.Filter)
+		return
+	}
+	page, err := app.store.ListUsers(r.Context(), opts)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	users := UserList{Items: []User{}, NextCursor: page.NextCursor}
+	for _, userData := range page.Users {
+		users.Items = append(users.Items, userFromData(userData))
+	}
+	if page.NextCursor != "" {
+		next := *r.URL
+		query.Set("cursor", page.NextCursor)
+		next.RawQuery = query.Encode()
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.RequestURI()))
 	}
 	renderJSONResp(w, http.StatusOK, users)
 }
 
+// listOptions reads the page, the filters and the order of GET /users from
+// query
+func listOptions(query url.Values) (v1.ListOptions, error) {
+	var opts v1.ListOptions
+	for name := range query {
+		if !listParams[name] {
+			return opts, fmt.Errorf("%w %q", ErrUnknownFilter, name)
+		}
+	}
+	var err error
+	if opts.Limit, err = limitParam(query); err != nil {
+		return opts, err
+	}
+	opts.Cursor = query.Get("cursor")
+	if opts.Sort, err = v1.ParseSort(query.Get("sort")); err != nil {
+		return opts, err
+	}
+	opts.Filter.City = query.Get("city")
+	opts.Filter.NamePrefix = query.Get("name_prefix")
+	if opts.Filter.MinAge, err = ageParam(query, "min_age", ErrInvalidMinAge); err != nil {
+		return opts, err
+	}
+	opts.Filter.MaxAge, err = ageParam(query, "max_age", ErrInvalidMaxAge)
+	return opts, err
+}
+
+// limitParam reads the page size in the query, 0 when it is not set
+func limitParam(query url.Values) (int, error) {
+	param := query.Get("limit")
+	if param == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(param)
+	if err != nil || limit < 1 || limit > v1.MaxPageLimit {
+		return 0, ErrInvalidLimit
+	}
+	return limit, nil
+}
+
+// ageParam reads the age in the query parameter name, nil when it is not set
+// and invalid when it is not a natural number
+func ageParam(query url.Values, name string, invalid error) (*int, error) {
+	param := query.Get(name)
+	if param == "" {
+		return nil, nil
+	}
+	age, err := strconv.Atoi(param)
+	if err != nil || age < 0 {
+		return nil, invalid
+	}
+	return &age, nil
+}
+
+// getUsersByEmail lists the user with email if it passes filter, there is at
+// most one
+func (app *App) getUsersByEmail(w http.ResponseWriter, r *http.Request, email string, filter v1.Filter) {
+	users := UserList{Items: []User{}}
+	userData, err := app.store.FindUserByEmail(r.Context(), email)
+	if err != nil && err != v1.ErrNoUserFound {
+		renderErrorResp(w, r, err)
+		return
+	}
+	if err == nil && filter.Matches(userData) {
+		users.Items = append(users.Items, userFromData(userData))
+	}
+	renderJSONResp(w, http.StatusOK, users)
+}
+
+// SearchResult is a user matching a search with the parts of its fields that
+// matched between <em> and </em>
+type SearchResult struct {
+	User       User              `json:"user"`
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights"`
+}
+
+type SearchResultList struct {
+	Items []SearchResult `json:"items"`
+}
+
+func (app *App) searchUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for name := range query {
+		if name != "q" && name != "limit" {
+			renderErrorResp(w, r, fmt.Errorf("%w %q", ErrUnknownFilter, name))
+			return
+		}
+	}
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		renderErrorResp(w, r, ErrQueryRequired)
+		return
+	}
+	limit, err := limitParam(query)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	results, err := app.store.SearchUsers(r.Context(), q, limit)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	list := SearchResultList{Items: []SearchResult{}}
+	for _, result := range results {
+		list.Items = append(list.Items, SearchResult{
+			User:       userFromData(result.User),
+			Score:      result.Score,
+			Highlights: result.Highlights,
+		})
+	}
+	renderJSONResp(w, http.StatusOK, list)
+}
+
+// UserStats sums up the users, Age is left out when there are none
+type UserStats struct {
+	Total  int            `json:"total"`
+	Cities map[string]int `json:"cities"`
+	Age    *AgeStats      `json:"age,omitempty"`
+}
+
+type AgeStats struct {
+	Min       int         `json:"min"`
+	Max       int         `json:"max"`
+	Mean      float64     `json:"mean"`
+	Histogram []AgeBucket `json:"histogram"`
+}
+
+// AgeBucket counts the users aged from Min to Max included
+type AgeBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+func (app *App) getUserStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := app.store.UserStats(r.Context())
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	resp := UserStats{Total: stats.Total, Cities: stats.Cities}
+	if stats.Total > 0 {
+		resp.Age = &AgeStats{Min: stats.MinAge, Max: stats.MaxAge, Mean: stats.MeanAge, Histogram: []AgeBucket{}}
+		for _, bucket := range stats.AgeHistogram {
+			resp.Age.Histogram = append(resp.Age.Histogram, AgeBucket(bucket))
+		}
+	}
+	renderJSONResp(w, http.StatusOK, resp)
+}
+
 func (app *App) getUserByID(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	userID, err := strconv.Atoi(params["id"])
 	if err != nil {
-		renderJSONErrorResp(w, http.StatusBadRequest, ErrInvalidUserID)
+		renderErrorResp(w, r, ErrInvalidUserID)
 		return
 	}
-	conn := app.pool.Get()
-	userData, err := v1.FindUserByID(conn, userID)
-	if err == v1.ErrNoUserFound {
-		renderJSONErrorResp(w, http.StatusNotFound, err)
+	userData, err := app.store.FindUserByID(r.Context(), userID)
+	if err != nil {
+		renderErrorResp(w, r, err)
 		return
 	}
+	renderUserResp(w, r, userData)
+}
+
+func (app *App) getUserByEmail(w http.ResponseWriter, r *http.Request) {
+	userData, err := app.store.FindUserByEmail(r.Context(), mux.Vars(r)["email"])
 	if err != nil {
-		renderJSONErrorResp(w, http.StatusInternalServerError, err)
+		renderErrorResp(w, r, err)
 		return
 	}
-	var user User
-	user.ID = userData.ID
-	user.Name = userData.Name
-	user.Age = userData.Age
-	user.City = userData.City
-	renderJSONResp(w, http.StatusOK, user)
+	renderUserResp(w, r, userData)
+}
+
+// renderUserResp sends the user with its ETag, or 304 Not Modified when the
+// client already has this version
+func renderUserResp(w http.ResponseWriter, r *http.Request, userData *v1.User) {
+	etag := userETag(userData.ID, userData.Version)
+	w.Header().Set("ETag", etag)
+	if ifNoneMatch(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	renderJSONResp(w, http.StatusOK, userFromData(userData))
+}
+
+func (app *App) deleteUser(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		renderErrorResp(w, r, ErrInvalidUserID)
+		return
+	}
+	var opts v1.DeleteOptions
+	if soft := r.URL.Query().Get("soft"); soft != "" {
+		opts.Soft, err = strconv.ParseBool(soft)
+		if err != nil {
+			renderErrorResp(w, r, ErrInvalidSoft)
+			return
+		}
+	}
+	precondition, err := parseIfMatch(r, userID)
+	if err != nil {
+		renderErrorResp(w, r, err)
+		return
+	}
+	opts.IfVersions = precondition.versions
+	if err := app.store.DeleteUser(r.Context(), userID, opts); err != nil {
+		renderErrorResp(w, r, precondition.storeError(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func renderJSONResp(w http.ResponseWriter, httpStatus int, data interface{}) {
@@ -150,20 +618,65 @@ func renderJSONResp(w http.ResponseWriter, httpStatus int, data interface{}) {
 	w.Write(response)
 }
 
-func renderJSONErrorResp(w http.ResponseWriter, httpStatus int, err error) {
-	response, _ := json.Marshal(map[string]string{"error": err.Error()})
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(httpStatus)
-	w.Write(response)
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
-func main() {
-	app := &App{}
-	redisURL := os.Getenv("REDIS_URL")
-	redisPassword := os.Getenv("REDIS_PASSWORD")
-	port := os.Getenv("PORT")
-
-	app.Initialize(redisURL, redisPassword)
-	app.loadInitData(app.pool.Get())
-	app.startServer(port)
+// run starts the API and blocks until it is shut down by SIGINT or SIGTERM
+func run() error {
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err == flag.ErrHelp {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cfg.PrintConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			return err
+		}
+		return cfg.Validate()
+	}
+	logger := logging.New(os.Stdout, cfg.Log.Level)
+	slog.SetDefault(logger)
+	shutdownTracing, err := tracing.Setup(cfg.Trace.Exporter, cfg.Trace.File)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("flushing traces", slog.String("error", err.Error()))
+		}
+	}()
+
+	app := &App{logger: logger}
+
+	if err := app.Initialize(cfg.Redis); err != nil {
+		return err
+	}
+	defer app.pool.Close()
+	if err := app.EnableAuth(cfg.Auth); err != nil {
+		return err
+	}
+	app.EnableRateLimit(cfg.RateLimit)
+	if err := app.loadInitData(); err != nil {
+		return fmt.Errorf("loading initial data: %v", err)
+	}
+
+	//stop serving on SIGINT or SIGTERM, letting in-flight requests finish
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	return app.startServer(ctx, cfg.Server)
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/metrics"
+)
+
+// appMetrics are the metrics served on /metrics
+type appMetrics struct {
+	registry        *metrics.Registry
+	requests        *metrics.CounterVec
+	requestDuration *metrics.HistogramVec
+	redisCommands   *metrics.HistogramVec
+	redisErrors     *metrics.CounterVec
+}
+
+// newAppMetrics registers the request and Redis command metrics, and gauges
+// read from the pool and the user store on every scrape
+func (app *App) newAppMetrics() *appMetrics {
+	registry := metrics.NewRegistry()
+	m := &appMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"HTTP requests served, by method, route template and status.",
+			"method", "route", "status"),
+		requestDuration: registry.NewHistogramVec("http_request_duration_seconds",
+			"Time to serve HTTP requests, by method, route template and status.",
+			nil, "method", "route", "status"),
+		redisCommands: registry.NewHistogramVec("redis_command_duration_seconds",
+			"Latency of the Redis commands sent by the user store, by command.",
+			nil, "command"),
+		redisErrors: registry.NewCounterVec("redis_command_errors_total",
+			"Redis commands sent by the user store that failed, by command.",
+			"command"),
+	}
+	registry.NewGaugeFunc("redis_pool_active_connections",
+		"Connections open in the Redis pool, idle or in use.",
+		app.poolStat(func(stats redis.PoolStats) int { return stats.ActiveCount }))
+	registry.NewGaugeFunc("redis_pool_idle_connections",
+		"Idle connections in the Redis pool.",
+		app.poolStat(func(stats redis.PoolStats) int { return stats.IdleCount }))
+	registry.NewGaugeFunc("users", "Users stored, not counting deleted ones.",
+		func(ctx context.Context) (float64, error) {
+			count, err := app.store.CountUsers(ctx)
+			return float64(count), err
+		})
+	return m
+}
+
+func (app *App) poolStat(stat func(redis.PoolStats) int) func(context.Context) (float64, error) {
+	return func(ctx context.Context) (float64, error) {
+		return float64(stat(app.pool.Stats())), nil
+	}
+}
+
+// observeRedisCommand is the v1.CommandObserver of the Redis user store
+func (m *appMetrics) observeRedisCommand(command string, latency time.Duration, err error) {
+	m.redisCommands.Observe(latency.Seconds(), command)
+	if err != nil && err != redis.ErrNil {
+		m.redisErrors.Inc(command)
+	}
+}
+
+// methodLabel is the method label of a request, the methods outside the
+// standard ones are all labelled OTHER so clients cannot add series at will
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// measureRequests counts the requests and records their latency by method,
+// route template and status, the route being empty when none matched
+func (app *App) measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := []string{methodLabel(r.Method), requestRoute(r), strconv.Itoa(status)}
+		app.metrics.requests.Inc(labels...)
+		app.metrics.requestDuration.Observe(time.Since(start).Seconds(), labels...)
+	})
+}
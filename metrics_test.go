@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rnidev/go-rest/pkg/metrics"
+)
+
+// scrape fetches /metrics and returns the value of every sample by its name
+// and labels, as written in the exposition format
+func scrape(t *testing.T, app *App) map[string]float64 {
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != metrics.ContentType {
+		t.Errorf("Content-Type: got %s, expected %s", ct, metrics.ContentType)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	defer conn.Close()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/user/1", "/user/1", "/user/124", "/users"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	samples := scrape(t, app)
+	expected := map[string]float64{
+		`http_requests_total{method="GET",route="/user/{id:[0-9]+}",status="200"}`:                 2,
+		`http_requests_total{method="GET",route="/user/{id:[0-9]+}",status="404"}`:                 1,
+		`http_requests_total{method="GET",route="/users",status="200"}`:                            1,
+		`http_request_duration_seconds_count{method="GET",route="/user/{id:[0-9]+}",status="200"}`: 2,
+		`http_request_duration_seconds_bucket{method="GET",route="/users",status="200",le="+Inf"}`: 1,
+		`redis_command_duration_seconds_count{command="PIPELINE"}`:                                 4,
+		`redis_command_duration_seconds_count{command="ZRANGEBYSCORE"}`:                            1,
+		`users`: 2,
+	}
+	for sample, value := range expected {
+		got, ok := samples[sample]
+		if !ok {
+			t.Errorf("sample %s missing", sample)
+			continue
+		}
+		if got != value {
+			t.Errorf("sample %s: got %v, expected %v", sample, got, value)
+		}
+	}
+	if _, ok := samples["redis_pool_active_connections"]; !ok {
+		t.Errorf("sample redis_pool_active_connections missing")
+	}
+	if idle := samples["redis_pool_idle_connections"]; idle < 1 {
+		t.Errorf("sample redis_pool_idle_connections: got %v, expected at least 1", idle)
+	}
+
+	//the scrape itself is counted on the next one
+	samples = scrape(t, app)
+	if got := samples[`http_requests_total{method="GET",route="/metrics",status="200"}`]; got != 1 {
+		t.Errorf("/metrics requests: got %v, expected 1", got)
+	}
+}
+
+func TestMetricsUnknownMethods(t *testing.T) {
+	app := setup()
+	for i := 0; i < 3; i++ {
+		req, _ := http.NewRequest("X"+strconv.Itoa(i), "/users", nil)
+		app.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	series := 0
+	for sample := range scrape(t, app) {
+		if strings.HasPrefix(sample, "http_requests_total{") {
+			series++
+			if !strings.Contains(sample, `method="OTHER"`) {
+				t.Errorf("sample %s: expected the method labelled OTHER", sample)
+			}
+		}
+	}
+	if series != 1 {
+		t.Errorf("http_requests_total series: got %d, expected 1", series)
+	}
+}
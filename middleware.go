@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/requestid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// responseRecorder remembers the status and the size of the response written
+// through it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// routeTemplate returns the path template of the mux route matching r, such as
+// /user/{id:[0-9]+}, so requests can be grouped without one group per ID
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	template, _ := route.GetPathTemplate()
+	return template
+}
+
+type routeKey struct{}
+
+// trackRoutes runs before the request middlewares, which wrap the router so
+// they see the requests no route matches as well. The route is only known once
+// the router matched it, recordRoute stores it where they can read it after
+// serving the request.
+func (app *App) trackRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var route string
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+	})
+}
+
+// requestRoute returns the template of the route r was served by, empty when
+// no route matched it
+func requestRoute(r *http.Request) string {
+	if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+		return *route
+	}
+	return ""
+}
+
+// recordRoute runs on the routes matched by the router, it stores their
+// template for trackRoutes and adds it to the span and the logger of the
+// request
+func (app *App) recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := routeTemplate(r)
+		if route, ok := r.Context().Value(routeKey{}).(*string); ok {
+			*route = template
+		}
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + template)
+		span.SetAttributes(attribute.String("http.route", template))
+		logger := logging.FromContext(r.Context()).With(slog.String("route", template))
+		next.ServeHTTP(w, r.WithContext(logging.NewContext(r.Context(), logger)))
+	})
+}
+
+// tagRequests gives every request an ID, the one sent by the client in
+// X-Request-ID when it is usable or a new one, and echoes it in the response
+func (app *App) tagRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestid.Header)
+		if !requestid.Valid(id) {
+			id = requestid.New()
+		}
+		w.Header().Set(requestid.Header, id)
+		next.ServeHTTP(w, r.WithContext(requestid.NewContext(r.Context(), id)))
+	})
+}
+
+// tracer creates a server span for every request, continuing the trace of the
+// W3C traceparent header when the client sent one
+var tracer = otel.Tracer("github.com/rnidev/go-rest")
+
+// traceRequests wraps every request in a span named after its method, and its
+// route template once recordRoute knows it. The span is in the request context
+// so Redis commands become its children.
+func (app *App) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("request.id", requestid.FromContext(r.Context())),
+			),
+		)
+		defer span.End()
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
+
+// logRequests logs one JSON line per request once it is served, and makes a
+// logger carrying the request attributes available through the request context
+func (app *App) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		logger := app.logger.With(
+			slog.String("method", r.Method),
+			slog.String("request_id", requestid.FromContext(r.Context())),
+		)
+		if span := trace.SpanContextFromContext(r.Context()); span.IsValid() {
+			logger = logger.With(slog.String("trace_id", span.TraceID().String()))
+		}
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(logging.NewContext(r.Context(), logger)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if rec.status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(r.Context(), level, "request",
+			slog.String("route", requestRoute(r)),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
+			slog.Float64("latency_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.String("remote_addr", r.RemoteAddr),
+		)
+	})
+}
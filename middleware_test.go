@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/requestid"
+)
+
+// logRecords decodes the JSON log lines written to out
+func logRecords(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRequestLogging(t *testing.T) {
+	app := setup()
+	conn := app.pool.Get()
+	defer conn.Close()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	app.logger = logging.New(&out, slog.LevelDebug)
+
+	req, _ := http.NewRequest("GET", "/user/1", nil)
+	req.Header.Set("X-Request-ID", "test-request")
+	req.RemoteAddr = "192.0.2.1:1234"
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	var request map[string]interface{}
+	redisCommands := 0
+	for _, record := range logRecords(t, &out) {
+		if record["request_id"] != "test-request" {
+			t.Errorf("log record %v: request_id missing", record)
+		}
+		switch record["msg"] {
+		case "request":
+			request = record
+		case "redis command":
+			redisCommands++
+		}
+	}
+	if request == nil {
+		t.Fatal("no request log record")
+	}
+	expect := map[string]interface{}{
+		"level":       "INFO",
+		"method":      "GET",
+		"route":       "/user/{id:[0-9]+}",
+		"path":        "/user/1",
+		"status":      float64(http.StatusOK),
+		"bytes":       float64(rr.Body.Len()),
+		"remote_addr": "192.0.2.1:1234",
+	}
+	for field, value := range expect {
+		if request[field] != value {
+			t.Errorf("request log %s: got %v, expected %v", field, request[field], value)
+		}
+	}
+	if _, ok := request["latency_ms"].(float64); !ok {
+		t.Errorf("request log latency_ms: got %v, expected a number", request["latency_ms"])
+	}
+	if redisCommands == 0 {
+		t.Errorf("no redis command logged at debug level")
+	}
+}
+
+func TestRequestLoggingLevel(t *testing.T) {
+	app := setup()
+	var out bytes.Buffer
+	app.logger = logging.New(&out, slog.LevelWarn)
+
+	req, _ := http.NewRequest("GET", "/user/1", nil)
+	app.ServeHTTP(httptest.NewRecorder(), req)
+	if out.Len() != 0 {
+		t.Errorf("logs below the warn level: %s", out.String())
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	app := setup()
+	tests := []struct {
+		sent      string
+		keepsSent bool
+	}{
+		{"", false},
+		{"client-id-1", true},
+		{"has spaces", false},
+		{strings.Repeat("x", 129), false},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", "/user/124", nil)
+		if test.sent != "" {
+			req.Header.Set("X-Request-ID", test.sent)
+		}
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		id := rr.Header().Get("X-Request-ID")
+		if test.keepsSent && id != test.sent {
+			t.Errorf("X-Request-ID %q: got %q, expected it echoed", test.sent, id)
+		}
+		if !test.keepsSent && (id == test.sent || !requestid.Valid(id)) {
+			t.Errorf("X-Request-ID %q: got %q, expected a new ID", test.sent, id)
+		}
+		var body struct {
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.RequestID != id {
+			t.Errorf("error body request_id: got %q, expected %q", body.RequestID, id)
+		}
+	}
+}
+
+func TestUnmatchedRequests(t *testing.T) {
+	app := setup()
+	var out bytes.Buffer
+	app.logger = logging.New(&out, slog.LevelInfo)
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/unknown", http.StatusNotFound},
+		{"DELETE", "/healthz", http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, test.path, nil)
+		req.Header.Set("X-Request-ID", "unmatched-request")
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("%s %s: http status code: got %v, expected %v", test.method, test.path, rr.Code, test.status)
+		}
+		if id := rr.Header().Get("X-Request-ID"); id != "unmatched-request" {
+			t.Errorf("%s %s: X-Request-ID: got %q, expected it echoed", test.method, test.path, id)
+		}
+	}
+
+	records := logRecords(t, &out)
+	if len(records) != len(tests) {
+		t.Fatalf("log records: got %d, expected one per request", len(records))
+	}
+	for i, record := range records {
+		if record["request_id"] != "unmatched-request" || record["status"] != float64(tests[i].status) || record["route"] != "" {
+			t.Errorf("log record %v: expected the request to %s with status %d and no route", record, tests[i].path, tests[i].status)
+		}
+	}
+	samples := scrape(t, app)
+	for _, sample := range []string{
+		`http_requests_total{method="GET",route="",status="404"}`,
+		`http_requests_total{method="DELETE",route="",status="405"}`,
+	} {
+		if got := samples[sample]; got != 1 {
+			t.Errorf("sample %s: got %v, expected 1", sample, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// APIKeyHeader carries an API key, "Authorization: ApiKey <key>" is accepted too
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyPrefix is the prefix of the Redis hashes of API keys, keyed by the hex
+// SHA-256 of the key so the keys themselves are never stored
+var apiKeyPrefix = "apikey:"
+
+// APIKeys authenticates requests with static API keys stored hashed in Redis
+type APIKeys struct {
+	pool *redis.Pool
+}
+
+func NewAPIKeys(pool *redis.Pool) *APIKeys {
+	return &APIKeys{pool: pool}
+}
+
+func (a *APIKeys) Scheme() string {
+	return "ApiKey"
+}
+
+func (a *APIKeys) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		var ok bool
+		if key, ok = credentials(r, a.Scheme()); !ok {
+			return nil, ErrNoCredentials
+		}
+	}
+	principal, err := a.Lookup(r.Context(), key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	if principal == nil {
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	return principal, nil
+}
+
+// Lookup returns the principal of key, nil if the key is unknown
+func (a *APIKeys) Lookup(ctx context.Context, key string) (*Principal, error) {
+	conn, err := a.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	values, err := redis.StringMap(conn.Do("HGETALL", apiKeyPrefix+HashAPIKey(key)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	principal := &Principal{Subject: values["subject"], Method: "api_key"}
+	if roles := values["roles"]; roles != "" {
+		principal.Roles = strings.Split(roles, ",")
+	}
+	return principal, nil
+}
+
+// Add stores the hash of key with the subject and roles of principal
+func (a *APIKeys) Add(ctx context.Context, key string, principal Principal) error {
+	conn, err := a.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("HMSET", apiKeyPrefix+HashAPIKey(key),
+		"subject", principal.Subject,
+		"roles", strings.Join(principal.Roles, ","))
+	return err
+}
+
+// Revoke deletes key, it is not an error if the key is unknown
+func (a *APIKeys) Revoke(ctx context.Context, key string) error {
+	conn, err := a.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", apiKeyPrefix+HashAPIKey(key))
+	return err
+}
+
+// HashAPIKey is the hex SHA-256 of key under which it is stored
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// GenerateAPIKey returns a random 256-bit key
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newAPIKeys(t *testing.T) (*APIKeys, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+	return NewAPIKeys(pool), s
+}
+
+func TestAPIKeys(t *testing.T) {
+	keys, s := newAPIKeys(t)
+	key, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Add(context.Background(), key, Principal{Subject: "ci", Roles: []string{"reader", "writer"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, stored := range s.Keys() {
+		if stored != apiKeyPrefix+HashAPIKey(key) {
+			t.Errorf("stored key %s, expected only the hash of the API key", stored)
+		}
+	}
+
+	for _, header := range [][2]string{{"X-API-Key", key}, {"Authorization", "ApiKey " + key}, {"Authorization", "apikey " + key}} {
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.Header.Set(header[0], header[1])
+		principal, err := keys.Authenticate(req)
+		if err != nil {
+			t.Errorf("%s: error: got %s, expected no error", header[0], err.Error())
+			continue
+		}
+		if principal.Subject != "ci" || principal.Method != "api_key" || len(principal.Roles) != 2 {
+			t.Errorf("%s: Authenticate() = %+v, expect ci with two roles", header[0], principal)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-API-Key", "unknown")
+	if _, err := keys.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown key: got %v, expected %s", err, ErrInvalidCredentials)
+	}
+	req, _ = http.NewRequest("GET", "/users", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	if _, err := keys.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("bearer token: got %v, expected %s", err, ErrNoCredentials)
+	}
+
+	if err := keys.Revoke(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	req, _ = http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-API-Key", key)
+	if _, err := keys.Authenticate(req); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("revoked key: got %v, expected %s", err, ErrInvalidCredentials)
+	}
+}
+
+func TestAPIKeysUnavailable(t *testing.T) {
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, errors.New("dial tcp: connection refused")
+		},
+	}
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.Header.Set("X-API-Key", "key")
+	_, err := NewAPIKeys(pool).Authenticate(req)
+	if !errors.Is(err, ErrUnavailable) || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("error: got %v, expected %s", err, ErrUnavailable)
+	}
+}
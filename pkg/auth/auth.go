@@ -0,0 +1,149 @@
+// Package auth authenticates HTTP requests with API keys or JWT bearer tokens
+// and carries the authenticated principal through the request context.
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator when the request carries
+	// none of the credentials it handles, so the next one can be tried
+	ErrNoCredentials = errors.New("authentication required")
+	// ErrInvalidCredentials is wrapped by the errors of credentials that were
+	// given but could not be verified
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnavailable is wrapped by the errors of authenticators that could not
+	// check the credentials they were given, such as a failing key store
+	ErrUnavailable = errors.New("credentials could not be checked")
+)
+
+// Principal is the authenticated caller
+type Principal struct {
+	Subject string
+	// Method is how the caller authenticated: api_key, jwt or header
+	Method string
+	Roles  []string
+}
+
+// Authenticator verifies one kind of credentials
+type Authenticator interface {
+	// Scheme is the auth-scheme advertised in WWW-Authenticate, such as Bearer,
+	// or empty for credentials that are not advertised
+	Scheme() string
+	// Authenticate returns the principal of the credentials of r,
+	// ErrNoCredentials when r has none of its kind
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// ErrorHandler writes the response of a request that failed authentication,
+// status is 401 for credentials that were missing or rejected and 500 when
+// they could not be checked
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, status int, err error)
+
+// Middleware rejects requests that no authenticator accepts with 401
+// Unauthorized and a WWW-Authenticate challenge per scheme. Without
+// authenticators every request is let through, unauthenticated.
+type Middleware struct {
+	realm          string
+	authenticators []Authenticator
+	onError        ErrorHandler
+}
+
+func NewMiddleware(realm string, onError ErrorHandler, authenticators ...Authenticator) *Middleware {
+	return &Middleware{realm: realm, authenticators: authenticators, onError: onError}
+}
+
+// Enabled reports whether any authenticator is configured
+func (m *Middleware) Enabled() bool {
+	return m != nil && len(m.authenticators) > 0
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	if !m.Enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, failed, err := m.authenticate(r)
+		if err != nil && !isCredentialsError(err) {
+			//the caller may have valid credentials, it is not challenged
+			m.onError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if err != nil {
+			m.challenge(w, failed, err)
+			m.onError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), principal)))
+	})
+}
+
+// authenticate tries every authenticator in turn, failed is the one that
+// rejected the credentials it was given
+func (m *Middleware) authenticate(r *http.Request) (*Principal, Authenticator, error) {
+	for _, authenticator := range m.authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			return nil, authenticator, err
+		}
+		return principal, nil, nil
+	}
+	return nil, nil, ErrNoCredentials
+}
+
+// isCredentialsError tells whether err is about the credentials of the
+// request, any other error is internal
+func isCredentialsError(err error) bool {
+	return err == ErrNoCredentials || errors.Is(err, ErrInvalidCredentials)
+}
+
+// challenge sets one WWW-Authenticate header per scheme, the scheme whose
+// credentials were rejected gets an invalid_token error as in RFC 6750.
+// Authenticators without a scheme are not advertised.
+func (m *Middleware) challenge(w http.ResponseWriter, failed Authenticator, err error) {
+	for _, authenticator := range m.authenticators {
+		if authenticator.Scheme() == "" {
+			continue
+		}
+		challenge := authenticator.Scheme() + ` realm="` + m.realm + `"`
+		if authenticator == failed {
+			challenge += `, error="invalid_token", error_description="` + quoteEscape(err.Error()) + `"`
+		}
+		w.Header().Add("WWW-Authenticate", challenge)
+	}
+}
+
+func quoteEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying principal
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// FromContext returns the principal stored in ctx by NewContext, or nil for
+// unauthenticated requests
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(contextKey{}).(*Principal)
+	return principal
+}
+
+// credentials returns the credentials of the Authorization header if it uses
+// scheme, compared case-insensitively
+func credentials(r *http.Request, scheme string) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) <= len(scheme) || !strings.EqualFold(header[:len(scheme)], scheme) || header[len(scheme)] != ' ' {
+		return "", false
+	}
+	return strings.TrimSpace(header[len(scheme)+1:]), true
+}
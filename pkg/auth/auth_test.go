@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// staticAuthenticator accepts the single token "Static good"
+type staticAuthenticator struct{}
+
+func (staticAuthenticator) Scheme() string { return "Static" }
+
+func (staticAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := credentials(r, "Static")
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	switch token {
+	case "good":
+	case "broken":
+		return nil, errors.New("store is down")
+	default:
+		return nil, fmt.Errorf("%w: bad token", ErrInvalidCredentials)
+	}
+	return &Principal{Subject: "static"}, nil
+}
+
+func newTestMiddleware(authenticators ...Authenticator) *Middleware {
+	onError := func(w http.ResponseWriter, r *http.Request, status int, err error) {
+		http.Error(w, err.Error(), status)
+	}
+	return NewMiddleware("go-rest", onError, authenticators...)
+}
+
+func principalHandler(w http.ResponseWriter, r *http.Request) {
+	if principal := FromContext(r.Context()); principal != nil {
+		w.Write([]byte(principal.Subject))
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	handler := newTestMiddleware().Handler(http.HandlerFunc(principalHandler))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/users", nil))
+	if rr.Code != http.StatusOK || rr.Body.Len() != 0 {
+		t.Errorf("got %v %q, expected 200 without a principal", rr.Code, rr.Body.String())
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	verifier, err := NewJWT(JWTOptions{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := newTestMiddleware(staticAuthenticator{}, verifier).Handler(http.HandlerFunc(principalHandler))
+
+	tests := []struct {
+		authorization string
+		status        int
+		body          string
+		challenges    []string
+	}{
+		{"", http.StatusUnauthorized, "authentication required", []string{`Static realm="go-rest"`, `Bearer realm="go-rest"`}},
+		{"Static good", http.StatusOK, "static", nil},
+		{"Static bad", http.StatusUnauthorized, "bad token", []string{`Static realm="go-rest", error="invalid_token", error_description="invalid credentials: bad token"`, `Bearer realm="go-rest"`}},
+		{"Static broken", http.StatusInternalServerError, "store is down", nil},
+		{"Bearer x.y.z", http.StatusUnauthorized, "invalid credentials", []string{`Static realm="go-rest"`, `Bearer realm="go-rest", error="invalid_token"`}},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/users", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != test.status {
+			t.Errorf("%q: http status code: got %v, expected %v", test.authorization, rr.Code, test.status)
+		}
+		if !strings.Contains(rr.Body.String(), test.body) {
+			t.Errorf("%q: response body: got %q, expected %q", test.authorization, rr.Body.String(), test.body)
+		}
+		challenges := rr.Header()["Www-Authenticate"]
+		if len(challenges) != len(test.challenges) {
+			t.Errorf("%q: WWW-Authenticate: got %q, expected %q", test.authorization, challenges, test.challenges)
+			continue
+		}
+		for i, challenge := range test.challenges {
+			if !strings.HasPrefix(challenges[i], challenge) {
+				t.Errorf("%q: WWW-Authenticate: got %q, expected %q", test.authorization, challenges[i], challenge)
+			}
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// JWTOptions configures the verification of bearer tokens. Tokens are signed
+// with HS256 by Secret or by an oct key of the JWKS file, or with RS256 by an
+// RSA key of the JWKS file. Issuer and Audience are checked when set.
+type JWTOptions struct {
+	Secret   string
+	JWKSFile string
+	Issuer   string
+	Audience string
+}
+
+// JWT authenticates requests with HS256 or RS256 JWT bearer tokens, the sub
+// claim is the subject of the principal and the roles claim its roles
+type JWT struct {
+	hmacKeys map[string][]byte
+	rsaKeys  map[string]*rsa.PublicKey
+	issuer   string
+	audience string
+	now      func() time.Time
+}
+
+func NewJWT(opts JWTOptions) (*JWT, error) {
+	j := &JWT{
+		hmacKeys: make(map[string][]byte),
+		rsaKeys:  make(map[string]*rsa.PublicKey),
+		issuer:   opts.Issuer,
+		audience: opts.Audience,
+		now:      time.Now,
+	}
+	if opts.Secret != "" {
+		j.hmacKeys[""] = []byte(opts.Secret)
+	}
+	if opts.JWKSFile != "" {
+		if err := j.loadJWKS(opts.JWKSFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(j.hmacKeys) == 0 && len(j.rsaKeys) == 0 {
+		return nil, errors.New("jwt: no secret nor key to verify tokens with")
+	}
+	return j, nil
+}
+
+// jwk is a JSON Web Key of a key set, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	// N and E are the modulus and exponent of RSA keys, K the value of oct keys
+	N string `json:"n"`
+	E string `json:"e"`
+	K string `json:"k"`
+}
+
+func (j *JWT) loadJWKS(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var keySet struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &keySet); err != nil {
+		return fmt.Errorf("jwks %s: %v", path, err)
+	}
+	for i, key := range keySet.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		switch key.Kty {
+		case "RSA":
+			publicKey, err := key.rsaPublicKey()
+			if err != nil {
+				return fmt.Errorf("jwks %s: key %d: %v", path, i, err)
+			}
+			j.rsaKeys[key.Kid] = publicKey
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.K, "="))
+			if err != nil || len(secret) == 0 {
+				return fmt.Errorf("jwks %s: key %d: invalid k", path, i)
+			}
+			j.hmacKeys[key.Kid] = secret
+		}
+	}
+	return nil
+}
+
+func (key jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.N, "="))
+	if err != nil || len(n) == 0 {
+		return nil, errors.New("invalid modulus n")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(key.E, "="))
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid exponent e")
+	}
+	exponent := 0
+	for _, b := range e {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+}
+
+func (j *JWT) Scheme() string {
+	return "Bearer"
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := credentials(r, j.Scheme())
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	principal, err := j.Verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return principal, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+	Roles     json.RawMessage `json:"roles"`
+}
+
+// Verify checks the signature and the claims of token and returns its principal
+func (j *JWT) Verify(token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if err := j.verifySignature(header, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := j.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	roles, err := stringList(claims.Roles, true)
+	if err != nil {
+		return nil, errors.New("roles claim must be a string or a list of strings")
+	}
+	return &Principal{Subject: claims.Subject, Method: "jwt", Roles: roles}, nil
+}
+
+func (j *JWT) verifySignature(header jwtHeader, signed string, signature []byte) error {
+	switch header.Alg {
+	case "HS256":
+		secret, ok := j.hmacKeys[header.Kid]
+		if !ok {
+			return fmt.Errorf("unknown HS256 key %q", header.Kid)
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+	case "RS256":
+		publicKey, ok := j.rsaKeys[header.Kid]
+		if !ok {
+			return fmt.Errorf("unknown RS256 key %q", header.Kid)
+		}
+		digest := sha256.Sum256([]byte(signed))
+		if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	return nil
+}
+
+func (j *JWT) checkClaims(claims jwtClaims) error {
+	now := j.now()
+	if claims.Subject == "" {
+		return errors.New("missing sub claim")
+	}
+	if claims.ExpiresAt == nil {
+		return errors.New("missing exp claim")
+	}
+	if now.After(unixTime(*claims.ExpiresAt).Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return errors.New("token not valid yet")
+	}
+	if j.issuer != "" && claims.Issuer != j.issuer {
+		return errors.New("unexpected issuer")
+	}
+	if j.audience != "" {
+		//a string aud is a single value (RFC 7519, section 4.1.3)
+		audiences, err := stringList(claims.Audience, false)
+		if err != nil || !contains(audiences, j.audience) {
+			return errors.New("unexpected audience")
+		}
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// stringList decodes a claim that is either a string, split on spaces when
+// spaced, or a list of strings
+func stringList(raw json.RawMessage, spaced bool) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if !spaced {
+			return []string{single}, nil
+		}
+		return strings.Fields(single), nil
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
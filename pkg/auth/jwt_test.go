@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func signHS256(t *testing.T, secret []byte, header, claims map[string]interface{}) string {
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// writeJWKS writes a key set with the public half of key under kid and an oct
+// key under kid "shared"
+func writeJWKS(t *testing.T, kid string, key *rsa.PrivateKey, shared []byte) string {
+	keySet := map[string]interface{}{"keys": []map[string]string{
+		{
+			"kty": "RSA", "kid": kid, "use": "sig", "alg": "RS256",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		},
+		{"kty": "oct", "kid": "shared", "k": base64.RawURLEncoding.EncodeToString(shared)},
+	}}
+	raw, _ := json.Marshal(keySet)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shared := []byte("shared secret of the key set")
+	verifier, err := NewJWT(JWTOptions{
+		Secret:   string(secret),
+		JWKSFile: writeJWKS(t, "rsa-1", rsaKey, shared),
+		Issuer:   "https://issuer.example",
+		Audience: "go-rest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	verifier.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice", "iss": "https://issuer.example", "aud": []string{"go-rest", "other"},
+			"exp": now.Add(time.Hour).Unix(), "roles": []string{"reader", "writer"},
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	hs256 := map[string]interface{}{"alg": "HS256", "typ": "JWT"}
+	rs256 := map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}
+
+	valid := map[string]string{
+		"HS256 secret":  signHS256(t, secret, hs256, claims(nil)),
+		"HS256 jwks":    signHS256(t, shared, map[string]interface{}{"alg": "HS256", "kid": "shared"}, claims(nil)),
+		"RS256 jwks":    signRS256(t, rsaKey, rs256, claims(nil)),
+		"audience":      signHS256(t, secret, hs256, claims(map[string]interface{}{"aud": "go-rest"})),
+		"spaced roles":  signHS256(t, secret, hs256, claims(map[string]interface{}{"roles": "reader writer"})),
+		"within leeway": signHS256(t, secret, hs256, claims(map[string]interface{}{"exp": now.Add(-10 * time.Second).Unix()})),
+	}
+	for name, token := range valid {
+		principal, err := verifier.Verify(token)
+		if err != nil {
+			t.Errorf("%s: error: got %s, expected no error", name, err.Error())
+			continue
+		}
+		if principal.Subject != "alice" || principal.Method != "jwt" || len(principal.Roles) != 2 || principal.Roles[1] != "writer" {
+			t.Errorf("%s: Verify() = %+v, expect alice with the reader and writer roles", name, principal)
+		}
+	}
+
+	invalid := map[string]string{
+		"malformed":       "not.a.token.at.all",
+		"wrong secret":    signHS256(t, []byte("wrong"), hs256, claims(nil)),
+		"wrong rsa key":   signRS256(t, otherKey, rs256, claims(nil)),
+		"unknown kid":     signRS256(t, rsaKey, map[string]interface{}{"alg": "RS256", "kid": "rsa-2"}, claims(nil)),
+		"alg none":        encodeSegment(t, map[string]string{"alg": "none"}) + "." + encodeSegment(t, claims(nil)) + ".",
+		"alg confusion":   signHS256(t, []byte("rsa-1"), map[string]interface{}{"alg": "HS256", "kid": "rsa-1"}, claims(nil)),
+		"expired":         signHS256(t, secret, hs256, claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})),
+		"missing exp":     signHS256(t, secret, hs256, claims(map[string]interface{}{"exp": nil})),
+		"not before":      signHS256(t, secret, hs256, claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		"missing sub":     signHS256(t, secret, hs256, claims(map[string]interface{}{"sub": nil})),
+		"wrong issuer":    signHS256(t, secret, hs256, claims(map[string]interface{}{"iss": "https://evil.example"})),
+		"wrong audience":  signHS256(t, secret, hs256, claims(map[string]interface{}{"aud": "other"})),
+		"spaced audience": signHS256(t, secret, hs256, claims(map[string]interface{}{"aud": "other go-rest"})),
+		"invalid roles":   signHS256(t, secret, hs256, claims(map[string]interface{}{"roles": 7})),
+		"tampered header": signHS256(t, secret, hs256, claims(nil))[:10] + "x" + signHS256(t, secret, hs256, claims(nil))[11:],
+	}
+	for name, token := range invalid {
+		if principal, err := verifier.Verify(token); err == nil {
+			t.Errorf("%s: Verify() = %+v, expected an error", name, principal)
+		}
+	}
+}
+
+func TestNewJWTWithoutKeys(t *testing.T) {
+	if _, err := NewJWT(JWTOptions{}); err == nil {
+		t.Errorf("error: got nil, expected no key error")
+	}
+	if _, err := NewJWT(JWTOptions{JWKSFile: filepath.Join(t.TempDir(), "missing.json")}); err == nil {
+		t.Errorf("error: got nil, expected a missing file error")
+	}
+}
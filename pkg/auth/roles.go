@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrForbidden is returned when the principal lacks the role a route requires
+var ErrForbidden = errors.New("forbidden")
+
+// Role grants access to a set of operations, each role also grants the ones
+// of the roles below it: admin > writer > reader
+type Role string
+
+const (
+	RoleReader Role = "reader"
+	RoleWriter Role = "writer"
+	RoleAdmin  Role = "admin"
+)
+
+var roleRanks = map[Role]int{
+	RoleReader: 1,
+	RoleWriter: 2,
+	RoleAdmin:  3,
+}
+
+// HasRole reports whether the principal has role or a role above it, a nil
+// principal has no role
+func (p *Principal) HasRole(role Role) bool {
+	if p == nil {
+		return false
+	}
+	required, ok := roleRanks[role]
+	if !ok {
+		return false
+	}
+	for _, r := range p.Roles {
+		if roleRanks[Role(r)] >= required {
+			return true
+		}
+	}
+	return false
+}
+
+// RolesHeader authenticates requests by the comma-separated roles of a request
+// header set by a trusted proxy, which must strip it from client requests. The
+// subject is read from SubjectHeader when it is set.
+type RolesHeader struct {
+	Header        string
+	SubjectHeader string
+}
+
+// Scheme is empty as the header is not a credential clients are challenged for
+func (h RolesHeader) Scheme() string {
+	return ""
+}
+
+func (h RolesHeader) Authenticate(r *http.Request) (*Principal, error) {
+	value := r.Header.Get(h.Header)
+	if value == "" {
+		return nil, ErrNoCredentials
+	}
+	principal := &Principal{Method: "header"}
+	if h.SubjectHeader != "" {
+		principal.Subject = r.Header.Get(h.SubjectHeader)
+	}
+	for _, role := range strings.Split(value, ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			principal.Roles = append(principal.Roles, role)
+		}
+	}
+	return principal, nil
+}
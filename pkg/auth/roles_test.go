@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		roles    []string
+		role     Role
+		expected bool
+	}{
+		{nil, RoleReader, false},
+		{[]string{"reader"}, RoleReader, true},
+		{[]string{"reader"}, RoleWriter, false},
+		{[]string{"writer"}, RoleReader, true},
+		{[]string{"writer"}, RoleAdmin, false},
+		{[]string{"auditor", "admin"}, RoleWriter, true},
+		{[]string{"auditor"}, RoleReader, false},
+		{[]string{"admin"}, Role("owner"), false},
+	}
+	for _, test := range tests {
+		principal := &Principal{Roles: test.roles}
+		if got := principal.HasRole(test.role); got != test.expected {
+			t.Errorf("%v.HasRole(%s) = %v, expect %v", test.roles, test.role, got, test.expected)
+		}
+	}
+	var anonymous *Principal
+	if anonymous.HasRole(RoleReader) {
+		t.Errorf("nil principal has the reader role")
+	}
+}
+
+func TestRolesHeader(t *testing.T) {
+	authenticator := RolesHeader{Header: "X-Roles", SubjectHeader: "X-User"}
+	req, _ := http.NewRequest("GET", "/users", nil)
+	if _, err := authenticator.Authenticate(req); err != ErrNoCredentials {
+		t.Errorf("without the header: got %v, expected %s", err, ErrNoCredentials)
+	}
+	req.Header.Set("X-Roles", "reader, writer,")
+	req.Header.Set("X-User", "alice")
+	principal, err := authenticator.Authenticate(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if principal.Subject != "alice" || principal.Method != "header" || len(principal.Roles) != 2 || principal.Roles[1] != "writer" {
+		t.Errorf("Authenticate() = %+v, expect alice with the reader and writer roles", principal)
+	}
+}
@@ -0,0 +1,495 @@
+// Package config loads the server configuration from defaults, an optional YAML
+// file, environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"encoding"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rnidev/go-rest/pkg/ratelimit"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Redis     RedisConfig     `yaml:"redis"`
+	Log       LogConfig       `yaml:"log"`
+	Trace     TraceConfig     `yaml:"trace"`
+	Auth      AuthConfig      `yaml:"auth"`
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// PrintConfig is set by --print-config, the server prints the effective
+	// configuration and exits instead of starting
+	PrintConfig bool `yaml:"-"`
+}
+
+// ServerConfig holds the listening port and the timeouts of the HTTP server
+type ServerConfig struct {
+	Port string `yaml:"port"`
+	// ReadTimeout and WriteTimeout bound the time spent reading a request and
+	// writing its response, IdleTimeout how long keep-alive connections stay open
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownDrain is how long /readyz reports not ready on shutdown before
+	// the server stops accepting connections, so load balancers can notice
+	ShutdownDrain time.Duration `yaml:"shutdown_drain"`
+	// ShutdownTimeout is how long in-flight requests get to finish on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+// RedisConfig holds how to reach Redis and the limits of the connection pool
+type RedisConfig struct {
+	// URL is either host:port or a redis:// or rediss:// URL, which may carry
+	// the password and the database index: rediss://:password@host:6380/2
+	URL      string `yaml:"url"`
+	Password string `yaml:"password"`
+	// DB is nil when unset, so an explicit 0 still wins over the URL
+	DB *int `yaml:"db,omitempty"`
+	// TLS is implied by the rediss:// scheme, TLSCAFile adds a CA to trust on
+	// top of the system roots
+	TLS           bool   `yaml:"tls"`
+	TLSSkipVerify bool   `yaml:"tls_skip_verify"`
+	TLSCAFile     string `yaml:"tls_ca_file"`
+	// MaxIdle connections are kept open between requests, at most MaxActive are
+	// open at once and callers wait for a free one when the pool is exhausted
+	MaxIdle     int           `yaml:"max_idle"`
+	MaxActive   int           `yaml:"max_active"`
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// HealthCheckInterval is how long a connection may sit idle before it is
+	// PINGed when taken from the pool
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+	// ConnectTimeout bounds opening a connection to Redis, ReadTimeout and
+	// WriteTimeout reading the reply to a command and writing it, so a stalled
+	// Redis fails the command and the connection leaves the pool
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	ReadTimeout    time.Duration `yaml:"read_timeout"`
+	WriteTimeout   time.Duration `yaml:"write_timeout"`
+	// PingTimeout bounds the PING of the readiness probe, including the wait
+	// for a connection from the pool
+	PingTimeout time.Duration `yaml:"ping_timeout"`
+}
+
+// LogConfig holds the minimum level of the JSON logs: debug, info, warn or error
+type LogConfig struct {
+	Level slog.Level `yaml:"level"`
+}
+
+// TraceConfig selects where spans are exported: stderr, the default, which keeps
+// them apart from the logs, stdout along with the logs, a file of OTLP JSON lines
+// or none, in which case trace context is still propagated
+type TraceConfig struct {
+	Exporter string `yaml:"exporter"`
+	File     string `yaml:"file"`
+}
+
+// AuthConfig enables authentication and authorization of the user routes,
+// which stay open when neither API keys, JWTs nor a roles header are enabled.
+// JWTs are enabled by a secret for HS256 or a JWKS file of HS256 and RS256 keys.
+type AuthConfig struct {
+	APIKeys     bool   `yaml:"api_keys"`
+	JWTSecret   string `yaml:"jwt_secret"`
+	JWKSFile    string `yaml:"jwks_file"`
+	JWTIssuer   string `yaml:"jwt_issuer"`
+	JWTAudience string `yaml:"jwt_audience"`
+	// RolesHeader names a header carrying the roles of the caller, set by a
+	// trusted proxy, and SubjectHeader one carrying its identity
+	RolesHeader   string `yaml:"roles_header"`
+	SubjectHeader string `yaml:"subject_header"`
+}
+
+// JWT reports whether bearer tokens are accepted
+func (c AuthConfig) JWT() bool {
+	return c.JWTSecret != "" || c.JWKSFile != ""
+}
+
+// RateLimitConfig limits the request rate of each client on each user route,
+// clients are told apart by their authenticated subject or else their IP. The
+// limit of a subject wins over the one of a route, which wins over Default.
+// Routes are keyed by "METHOD template" or by template for every method, such
+// as "POST /users" or "/user/{id:[0-9]+}".
+type RateLimitConfig struct {
+	Default  ratelimit.Limit            `yaml:"default"`
+	Routes   map[string]ratelimit.Limit `yaml:"routes"`
+	Subjects map[string]ratelimit.Limit `yaml:"subjects"`
+	// IP limits the requests of each IP address to all the user routes. It is
+	// counted before authentication, so requests with bad credentials count.
+	IP ratelimit.Limit `yaml:"ip"`
+}
+
+// Enabled reports whether any limit is set
+func (c RateLimitConfig) Enabled() bool {
+	return !c.Default.IsZero() || len(c.Routes) > 0 || len(c.Subjects) > 0 || !c.IP.IsZero()
+}
+
+// RedisEndpoint is where and how to dial Redis, resolved from RedisConfig
+type RedisEndpoint struct {
+	Address  string
+	Password string
+	DB       int
+	TLS      bool
+}
+
+const redacted = "REDACTED"
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ReadTimeout:     10 * time.Second,
+			WriteTimeout:    10 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownDrain:   5 * time.Second,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Redis: RedisConfig{
+			MaxIdle:             10,
+			MaxActive:           50,
+			IdleTimeout:         240 * time.Second,
+			HealthCheckInterval: time.Minute,
+			ConnectTimeout:      5 * time.Second,
+			ReadTimeout:         3 * time.Second,
+			WriteTimeout:        3 * time.Second,
+			PingTimeout:         2 * time.Second,
+		},
+		Trace: TraceConfig{Exporter: "stderr"},
+	}
+}
+
+// setting is a value that can be set from the environment and from a flag
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(value string) error
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"port", "PORT", "port to listen on", stringSetter(&c.Server.Port)},
+		{"read-timeout", "READ_TIMEOUT", "max time to read a request", durationSetter(&c.Server.ReadTimeout)},
+		{"write-timeout", "WRITE_TIMEOUT", "max time to write a response", durationSetter(&c.Server.WriteTimeout)},
+		{"idle-timeout", "IDLE_TIMEOUT", "how long idle keep-alive connections stay open", durationSetter(&c.Server.IdleTimeout)},
+		{"shutdown-drain", "SHUTDOWN_DRAIN", "how long /readyz reports not ready before the server stops accepting connections on shutdown", durationSetter(&c.Server.ShutdownDrain)},
+		{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long in-flight requests get to finish on shutdown", durationSetter(&c.Server.ShutdownTimeout)},
+		{"redis-url", "REDIS_URL", "host:port or redis:// URL of Redis", stringSetter(&c.Redis.URL)},
+		{"redis-password", "REDIS_PASSWORD", "password of Redis", stringSetter(&c.Redis.Password)},
+		{"redis-db", "REDIS_DB", "Redis database index", intPtrSetter(&c.Redis.DB)},
+		{"redis-tls", "REDIS_TLS", "connect to Redis over TLS", boolSetter(&c.Redis.TLS)},
+		{"redis-tls-skip-verify", "REDIS_TLS_SKIP_VERIFY", "skip verification of the Redis certificate", boolSetter(&c.Redis.TLSSkipVerify)},
+		{"redis-tls-ca-file", "REDIS_TLS_CA_FILE", "PEM file of a CA to trust for Redis", stringSetter(&c.Redis.TLSCAFile)},
+		{"redis-max-idle", "REDIS_MAX_IDLE", "idle connections kept in the pool", intSetter(&c.Redis.MaxIdle)},
+		{"redis-max-active", "REDIS_MAX_ACTIVE", "max open connections to Redis", intSetter(&c.Redis.MaxActive)},
+		{"redis-idle-timeout", "REDIS_IDLE_TIMEOUT", "close connections idle for longer", durationSetter(&c.Redis.IdleTimeout)},
+		{"redis-health-check-interval", "REDIS_HEALTH_CHECK_INTERVAL", "PING connections idle for longer before use", durationSetter(&c.Redis.HealthCheckInterval)},
+		{"redis-connect-timeout", "REDIS_CONNECT_TIMEOUT", "max time to open a connection to Redis", durationSetter(&c.Redis.ConnectTimeout)},
+		{"redis-read-timeout", "REDIS_READ_TIMEOUT", "max time to read the reply to a Redis command", durationSetter(&c.Redis.ReadTimeout)},
+		{"redis-write-timeout", "REDIS_WRITE_TIMEOUT", "max time to write a Redis command", durationSetter(&c.Redis.WriteTimeout)},
+		{"redis-ping-timeout", "REDIS_PING_TIMEOUT", "max time for the readiness probe to PING Redis", durationSetter(&c.Redis.PingTimeout)},
+		{"log-level", "LOG_LEVEL", "minimum level of the logs: debug, info, warn or error", levelSetter(&c.Log.Level)},
+		{"auth-api-keys", "AUTH_API_KEYS", "accept the API keys stored in Redis", boolSetter(&c.Auth.APIKeys)},
+		{"auth-jwt-secret", "AUTH_JWT_SECRET", "secret of HS256 bearer tokens", stringSetter(&c.Auth.JWTSecret)},
+		{"auth-jwks-file", "AUTH_JWKS_FILE", "JWKS file of the keys of bearer tokens", stringSetter(&c.Auth.JWKSFile)},
+		{"auth-jwt-issuer", "AUTH_JWT_ISSUER", "required iss claim of bearer tokens", stringSetter(&c.Auth.JWTIssuer)},
+		{"auth-jwt-audience", "AUTH_JWT_AUDIENCE", "required aud claim of bearer tokens", stringSetter(&c.Auth.JWTAudience)},
+		{"auth-roles-header", "AUTH_ROLES_HEADER", "header of the caller roles set by a trusted proxy", stringSetter(&c.Auth.RolesHeader)},
+		{"auth-subject-header", "AUTH_SUBJECT_HEADER", "header of the caller identity set by a trusted proxy", stringSetter(&c.Auth.SubjectHeader)},
+		{"rate-limit", "RATE_LIMIT", "default request rate of each client on each route, such as 100/1m", textSetter(&c.RateLimit.Default)},
+		{"rate-limit-routes", "RATE_LIMIT_ROUTES", "rates by route, such as POST /users=10/1m;GET /users=100/1m", limitsSetter(&c.RateLimit.Routes)},
+		{"rate-limit-subjects", "RATE_LIMIT_SUBJECTS", "rates by authenticated subject, such as ci=1000/1m", limitsSetter(&c.RateLimit.Subjects)},
+		{"rate-limit-ip", "RATE_LIMIT_IP", "rate of each IP address on all the user routes, counted before authentication, such as 300/1m", textSetter(&c.RateLimit.IP)},
+		{"trace-exporter", "TRACE_EXPORTER", "where spans are exported: stderr, stdout, file or none", stringSetter(&c.Trace.Exporter)},
+		{"trace-file", "TRACE_FILE", "file the spans are appended to as OTLP JSON with the file exporter", stringSetter(&c.Trace.File)},
+	}
+}
+
+// Load reads the configuration file named by --config or CONFIG_FILE, then
+// overrides it with the environment and then with the flags in args, and
+// validates the result. Validation is left to the caller when --print-config is
+// set, so an incomplete configuration can still be printed. It returns
+// flag.ErrHelp when -h was passed.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	//flags are parsed first to find the config file, but only applied last
+	fs := flag.NewFlagSet("go-rest", flag.ContinueOnError)
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		fs.Var(flagValue{name: s.flag, values: flagValues}, s.flag, s.usage+" (env "+s.env+")")
+	}
+	configFile := fs.String("config", getenv("CONFIG_FILE"), "optional YAML configuration file (env CONFIG_FILE)")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "print the effective configuration, secrets redacted, and exit")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range settings {
+		if value := getenv(s.env); value != "" {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("invalid %s %q: %v", s.env, value, err)
+			}
+		}
+	}
+	for _, s := range settings {
+		if value, ok := flagValues[s.flag]; ok {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("invalid -%s %q: %v", s.flag, value, err)
+			}
+		}
+	}
+	if cfg.PrintConfig {
+		return cfg, nil
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Validate reports every missing or invalid value at once
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Server.Port == "" {
+		problems = append(problems, "port is required")
+	} else if port, err := strconv.Atoi(c.Server.Port); err != nil || port < 0 || port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %q is not a valid port number", c.Server.Port))
+	}
+	for name, d := range map[string]time.Duration{
+		"read timeout":          c.Server.ReadTimeout,
+		"write timeout":         c.Server.WriteTimeout,
+		"shutdown timeout":      c.Server.ShutdownTimeout,
+		"redis connect timeout": c.Redis.ConnectTimeout,
+		"redis read timeout":    c.Redis.ReadTimeout,
+		"redis write timeout":   c.Redis.WriteTimeout,
+		"redis ping timeout":    c.Redis.PingTimeout,
+	} {
+		if d <= 0 {
+			problems = append(problems, name+" must be positive")
+		}
+	}
+	if c.Server.ShutdownDrain < 0 {
+		problems = append(problems, "shutdown drain must not be negative")
+	}
+	if c.Redis.URL == "" {
+		problems = append(problems, "redis url is required")
+	} else if _, err := c.Redis.Endpoint(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if c.Redis.MaxIdle < 0 || c.Redis.MaxActive < 0 {
+		problems = append(problems, "redis pool limits must not be negative")
+	}
+	if c.Trace.Exporter == "" {
+		problems = append(problems, "trace exporter is required, none disables exporting")
+	} else if c.Trace.Exporter == "file" && c.Trace.File == "" {
+		problems = append(problems, "trace file is required by the file exporter")
+	}
+	if len(problems) > 0 {
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Endpoint resolves URL, explicit Password, DB and TLS options win over the
+// ones carried by the URL
+func (c RedisConfig) Endpoint() (RedisEndpoint, error) {
+	endpoint := RedisEndpoint{Password: c.Password, TLS: c.TLS}
+	if c.DB != nil {
+		endpoint.DB = *c.DB
+	}
+	if !strings.Contains(c.URL, "://") {
+		if _, _, err := net.SplitHostPort(c.URL); err != nil {
+			return endpoint, fmt.Errorf("redis url %q: %v", c.URL, err)
+		}
+		endpoint.Address = c.URL
+		return endpoint, nil
+	}
+
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return endpoint, fmt.Errorf("redis url: %v", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return endpoint, fmt.Errorf("redis url scheme %q must be redis or rediss", u.Scheme)
+	}
+	host, port := u.Hostname(), u.Port()
+	if host == "" {
+		host = "localhost"
+	}
+	if port == "" {
+		port = "6379"
+	}
+	endpoint.Address = net.JoinHostPort(host, port)
+	endpoint.TLS = endpoint.TLS || u.Scheme == "rediss"
+	if password, ok := u.User.Password(); ok && endpoint.Password == "" {
+		endpoint.Password = password
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" && c.DB == nil {
+		db, err := strconv.Atoi(path)
+		if err != nil || db < 0 {
+			return endpoint, fmt.Errorf("redis url database %q is not a valid index", path)
+		}
+		endpoint.DB = db
+	}
+	return endpoint, nil
+}
+
+// Redacted returns a copy of the configuration safe to print, with the
+// passwords and secrets replaced
+func (c *Config) Redacted() *Config {
+	redactedCfg := *c
+	if redactedCfg.Redis.Password != "" {
+		redactedCfg.Redis.Password = redacted
+	}
+	if redactedCfg.Auth.JWTSecret != "" {
+		redactedCfg.Auth.JWTSecret = redacted
+	}
+	if u, err := url.Parse(c.Redis.URL); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			redactedCfg.Redis.URL = u.String()
+		}
+	}
+	return &redactedCfg
+}
+
+// Print writes the configuration as YAML with secrets redacted
+func (c *Config) Print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	defer encoder.Close()
+	return encoder.Encode(c.Redacted())
+}
+
+// flagValue records the raw value of a flag so it can be applied after the
+// environment, giving flags the highest precedence
+type flagValue struct {
+	name   string
+	values map[string]string
+}
+
+func (f flagValue) String() string { return "" }
+
+func (f flagValue) Set(value string) error {
+	f.values[f.name] = value
+	return nil
+}
+
+func stringSetter(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+func intSetter(target *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		*target = n
+		return nil
+	}
+}
+
+func intPtrSetter(target **int) func(string) error {
+	return func(value string) error {
+		var n int
+		if err := intSetter(&n)(value); err != nil {
+			return err
+		}
+		*target = &n
+		return nil
+	}
+}
+
+func boolSetter(target *bool) func(string) error {
+	return func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		*target = b
+		return nil
+	}
+}
+
+func levelSetter(target *slog.Level) func(string) error {
+	return func(value string) error {
+		if err := target.UnmarshalText([]byte(value)); err != nil {
+			return errors.New("not one of debug, info, warn or error")
+		}
+		return nil
+	}
+}
+
+func textSetter(target encoding.TextUnmarshaler) func(string) error {
+	return func(value string) error {
+		return target.UnmarshalText([]byte(value))
+	}
+}
+
+// limitsSetter parses key=limit pairs separated by semicolons, as route
+// templates may contain commas
+func limitsSetter(target *map[string]ratelimit.Limit) func(string) error {
+	return func(value string) error {
+		limits := make(map[string]ratelimit.Limit)
+		for _, pair := range strings.Split(value, ";") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			i := strings.LastIndex(pair, "=")
+			if i <= 0 {
+				return fmt.Errorf("%q is not key=limit", pair)
+			}
+			limit, err := ratelimit.ParseLimit(strings.TrimSpace(pair[i+1:]))
+			if err != nil {
+				return err
+			}
+			limits[strings.TrimSpace(pair[:i])] = limit
+		}
+		*target = limits
+		return nil
+	}
+}
+
+func durationSetter(target *time.Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("not a duration such as 5s")
+		}
+		*target = d
+		return nil
+	}
+}
@@ -0,0 +1,302 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rnidev/go-rest/pkg/ratelimit"
+)
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFromEnv(t *testing.T) {
+	cfg, err := Load(nil, env(map[string]string{
+		"PORT":             "9090",
+		"READ_TIMEOUT":     "3s",
+		"REDIS_URL":        "localhost:6379",
+		"REDIS_MAX_ACTIVE": "20",
+	}))
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if cfg.Server.Port != "9090" || cfg.Server.ReadTimeout != 3*time.Second {
+		t.Errorf("Load() server = %+v, expect port 9090 and a 3s read timeout", cfg.Server)
+	}
+	if cfg.Log.Level != slog.LevelInfo {
+		t.Errorf("Log.Level = %v, expect the default INFO", cfg.Log.Level)
+	}
+	if cfg.Trace.Exporter != "stderr" {
+		t.Errorf("Trace.Exporter = %q, expect the default stderr so spans stay out of the logs", cfg.Trace.Exporter)
+	}
+	if cfg.Server.WriteTimeout != Default().Server.WriteTimeout {
+		t.Errorf("WriteTimeout = %v, expect default %v", cfg.Server.WriteTimeout, Default().Server.WriteTimeout)
+	}
+	if cfg.Redis.URL != "localhost:6379" || cfg.Redis.MaxActive != 20 || cfg.Redis.MaxIdle != Default().Redis.MaxIdle {
+		t.Errorf("Load() redis = %+v, expect URL localhost:6379, MaxActive 20 and the default MaxIdle", cfg.Redis)
+	}
+}
+
+func TestLoadInvalidEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"READ_TIMEOUT":     "soon",
+		"REDIS_MAX_ACTIVE": "-1",
+		"REDIS_TLS":        "maybe",
+		"LOG_LEVEL":        "loud",
+		"SHUTDOWN_DRAIN":   "-1s",
+	} {
+		values := map[string]string{"PORT": "8080", "REDIS_URL": "localhost:6379", name: value}
+		if _, err := Load(nil, env(values)); err == nil {
+			t.Errorf("%s=%s: got nil, expected an error", name, value)
+		}
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: "7070"
+  read_timeout: 4s
+  write_timeout: 6s
+redis:
+  url: file:6379
+  max_idle: 3
+log:
+  level: warn
+`)
+	cfg, err := Load(
+		[]string{"-config", path, "-port", "9090"},
+		env(map[string]string{"PORT": "8080", "READ_TIMEOUT": "5s"}),
+	)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if cfg.Server.Port != "9090" {
+		t.Errorf("Port = %s, expect the flag to win with 9090", cfg.Server.Port)
+	}
+	if cfg.Server.ReadTimeout != 5*time.Second {
+		t.Errorf("ReadTimeout = %v, expect the env to win with 5s", cfg.Server.ReadTimeout)
+	}
+	if cfg.Server.WriteTimeout != 6*time.Second || cfg.Redis.URL != "file:6379" || cfg.Redis.MaxIdle != 3 {
+		t.Errorf("Load() = %+v, expect the values of the file", cfg)
+	}
+	if cfg.Log.Level != slog.LevelWarn {
+		t.Errorf("Log.Level = %v, expect WARN from the file", cfg.Log.Level)
+	}
+	if cfg.Server.IdleTimeout != Default().Server.IdleTimeout {
+		t.Errorf("IdleTimeout = %v, expect default %v", cfg.Server.IdleTimeout, Default().Server.IdleTimeout)
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  port: \"7070\"\nredis:\n  url: localhost:6379\n")
+	cfg, err := Load(nil, env(map[string]string{"CONFIG_FILE": path}))
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if cfg.Server.Port != "7070" {
+		t.Errorf("Port = %s, expect 7070", cfg.Server.Port)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	if _, err := Load([]string{"-config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil)); err == nil {
+		t.Errorf("missing file: got nil, expected an error")
+	}
+	path := writeConfigFile(t, "server:\n  prot: \"7070\"\n")
+	if _, err := Load([]string{"-config", path}, env(nil)); err == nil {
+		t.Errorf("unknown field: got nil, expected an error")
+	}
+}
+
+func TestLoadRequiredValues(t *testing.T) {
+	_, err := Load(nil, env(nil))
+	if err == nil {
+		t.Fatal("error: got nil, expected missing port and redis url")
+	}
+	for _, expect := range []string{"port is required", "redis url is required"} {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("error: got %q, expected it to contain %q", err.Error(), expect)
+		}
+	}
+	if _, err := Load([]string{"-port", "http"}, env(map[string]string{"REDIS_URL": "localhost:6379"})); err == nil {
+		t.Errorf("invalid port: got nil, expected an error")
+	}
+	_, err = Load([]string{"-trace-exporter", "file"}, env(map[string]string{"PORT": "8080", "REDIS_URL": "localhost:6379"}))
+	if err == nil || !strings.Contains(err.Error(), "trace file is required") {
+		t.Errorf("file exporter without a file: got %v, expected a missing trace file error", err)
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	_, err := Load([]string{"-h"}, env(nil))
+	if err != flag.ErrHelp {
+		t.Errorf("error: got %v, expected %s", err, flag.ErrHelp)
+	}
+}
+
+func intPtr(n int) *int {
+	return &n
+}
+
+func TestRedisEndpoint(t *testing.T) {
+	tests := []struct {
+		cfg    RedisConfig
+		expect RedisEndpoint
+	}{
+		{RedisConfig{URL: "localhost:6379"}, RedisEndpoint{Address: "localhost:6379"}},
+		{RedisConfig{URL: "redis://cache:6380/2"}, RedisEndpoint{Address: "cache:6380", DB: 2}},
+		{RedisConfig{URL: "redis://cache"}, RedisEndpoint{Address: "cache:6379"}},
+		{RedisConfig{URL: "rediss://:secret@cache:6380/1"}, RedisEndpoint{Address: "cache:6380", Password: "secret", DB: 1, TLS: true}},
+		{RedisConfig{URL: "redis://:secret@cache/1", Password: "other", DB: intPtr(3)}, RedisEndpoint{Address: "cache:6379", Password: "other", DB: 3}},
+		{RedisConfig{URL: "redis://cache/1", DB: intPtr(0)}, RedisEndpoint{Address: "cache:6379"}},
+		{RedisConfig{URL: "cache:6379", TLS: true}, RedisEndpoint{Address: "cache:6379", TLS: true}},
+	}
+	for _, test := range tests {
+		endpoint, err := test.cfg.Endpoint()
+		if err != nil {
+			t.Errorf("%s: error: got %s, expected no error", test.cfg.URL, err.Error())
+			continue
+		}
+		if endpoint != test.expect {
+			t.Errorf("%s: Endpoint() = %+v, expect %+v", test.cfg.URL, endpoint, test.expect)
+		}
+	}
+
+	for _, url := range []string{"localhost", "http://cache:6379", "redis://cache/db"} {
+		if _, err := (RedisConfig{URL: url}).Endpoint(); err == nil {
+			t.Errorf("%s: got nil, expected an invalid url error", url)
+		}
+	}
+}
+
+func TestLoadRedisDB(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  port: \"8080\"\nredis:\n  url: redis://cache/2\n  db: 0\n")
+	cfg, err := Load([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if endpoint, _ := cfg.Redis.Endpoint(); endpoint.DB != 0 {
+		t.Errorf("file db 0: Endpoint().DB = %d, expect 0 over the database of the URL", endpoint.DB)
+	}
+
+	cfg, err = Load([]string{"-redis-db", "0"}, env(map[string]string{"PORT": "8080", "REDIS_URL": "redis://cache/2"}))
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if endpoint, _ := cfg.Redis.Endpoint(); endpoint.DB != 0 {
+		t.Errorf("-redis-db 0: Endpoint().DB = %d, expect 0 over the database of the URL", endpoint.DB)
+	}
+}
+
+func TestLoadPrintConfigSkipsValidation(t *testing.T) {
+	cfg, err := Load([]string{"-print-config"}, env(map[string]string{"REDIS_PASSWORD": "secret"}))
+	if err != nil {
+		t.Fatalf("error: got %s, expected the invalid configuration to be returned for printing", err.Error())
+	}
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "password: "+redacted) {
+		t.Errorf("printed config is missing the redacted password:\n%s", out.String())
+	}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "port is required") {
+		t.Errorf("Validate(): got %v, expected the missing port to be reported", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	cfg, err := Load(
+		[]string{"-print-config", "-redis-url", "rediss://:urlsecret@cache:6380/1"},
+		env(map[string]string{"PORT": "8080", "REDIS_PASSWORD": "envsecret", "AUTH_JWT_SECRET": "jwtsecret"}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.PrintConfig {
+		t.Errorf("PrintConfig = false, expect true")
+	}
+	var out bytes.Buffer
+	if err := cfg.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"urlsecret", "envsecret", "jwtsecret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("printed config contains %q:\n%s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), "port: \"8080\"") || !strings.Contains(out.String(), "cache:6380") {
+		t.Errorf("printed config is missing values:\n%s", out.String())
+	}
+	if cfg.Redis.Password != "envsecret" {
+		t.Errorf("Print() changed the config, password = %q", cfg.Redis.Password)
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: "8080"
+redis:
+  url: localhost:6379
+rate_limit:
+  default: 100/1m
+  routes:
+    POST /users: 10/1m
+  subjects:
+    ci: 1000/h
+  ip: 300/1m
+`)
+	cfg, err := Load([]string{"-config", path}, env(map[string]string{
+		"RATE_LIMIT_ROUTES": "GET /user/{id:[0-9]{1,9}}=5/s; /users=50/1m",
+	}))
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if !cfg.RateLimit.Enabled() || cfg.RateLimit.Default != (ratelimit.Limit{Requests: 100, Per: time.Minute}) {
+		t.Errorf("RateLimit.Default = %v, expect 100/1m", cfg.RateLimit.Default)
+	}
+	expectedRoutes := map[string]ratelimit.Limit{
+		"GET /user/{id:[0-9]{1,9}}": {Requests: 5, Per: time.Second},
+		"/users":                    {Requests: 50, Per: time.Minute},
+	}
+	if len(cfg.RateLimit.Routes) != len(expectedRoutes) {
+		t.Errorf("RateLimit.Routes = %v, expect the env to replace the file with %v", cfg.RateLimit.Routes, expectedRoutes)
+	}
+	for route, limit := range expectedRoutes {
+		if cfg.RateLimit.Routes[route] != limit {
+			t.Errorf("RateLimit.Routes[%s] = %v, expect %v", route, cfg.RateLimit.Routes[route], limit)
+		}
+	}
+	if cfg.RateLimit.Subjects["ci"] != (ratelimit.Limit{Requests: 1000, Per: time.Hour}) {
+		t.Errorf("RateLimit.Subjects = %v, expect ci 1000/h", cfg.RateLimit.Subjects)
+	}
+	if cfg.RateLimit.IP != (ratelimit.Limit{Requests: 300, Per: time.Minute}) {
+		t.Errorf("RateLimit.IP = %v, expect 300/1m", cfg.RateLimit.IP)
+	}
+
+	for _, value := range []string{"10", "/users", "/users=10/forever"} {
+		_, err := Load([]string{"-rate-limit-routes", value}, env(map[string]string{"PORT": "8080", "REDIS_URL": "localhost:6379"}))
+		if err == nil {
+			t.Errorf("-rate-limit-routes %q: got nil, expected an error", value)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+)
+
+func TestFromContext(t *testing.T) {
+	if logger := FromContext(context.Background()); logger != slog.Default() {
+		t.Errorf("FromContext() without a logger = %v, expect the default logger", logger)
+	}
+
+	var out bytes.Buffer
+	logger := New(&out, slog.LevelInfo).With("request_id", "abc")
+	ctx := NewContext(context.Background(), logger)
+	FromContext(ctx).Debug("dropped")
+	FromContext(ctx).Info("kept", "status", 200)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("log output %q is not a single JSON line: %v", out.String(), err)
+	}
+	if record["msg"] != "kept" || record["request_id"] != "abc" || record["status"] != float64(200) {
+		t.Errorf("log record = %v, expect msg kept with request_id and status", record)
+	}
+}
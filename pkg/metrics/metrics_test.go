@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "Requests served.", "route", "status")
+	c.Inc("/users", "200")
+	c.Inc("/users", "200")
+	c.Add(3, "/user/{id}", "404")
+
+	var out bytes.Buffer
+	if err := r.Write(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/user/{id}",status="404"} 3
+requests_total{route="/users",status="200"} 2
+`
+	if out.String() != expected {
+		t.Errorf("Write() =\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("latency_seconds", "Latency.", []float64{0.1, 1}, "command")
+	h.Observe(0.05, "GET")
+	h.Observe(0.5, "GET")
+	h.Observe(2, "GET")
+
+	var out bytes.Buffer
+	if err := r.Write(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{command="GET",le="0.1"} 1
+latency_seconds_bucket{command="GET",le="1"} 2
+latency_seconds_bucket{command="GET",le="+Inf"} 3
+latency_seconds_sum{command="GET"} 2.55
+latency_seconds_count{command="GET"} 3
+`
+	if out.String() != expected {
+		t.Errorf("Write() =\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	r.NewGaugeFunc("users", "Users stored.", func(ctx context.Context) (float64, error) {
+		return 42, nil
+	})
+	r.NewGaugeFunc("broken", "Fails to read.", func(ctx context.Context) (float64, error) {
+		return 0, errors.New("unavailable")
+	})
+
+	var out bytes.Buffer
+	if err := r.Write(context.Background(), &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# HELP users Users stored.\n# TYPE users gauge\nusers 42\n"
+	if out.String() != expected {
+		t.Errorf("Write() =\n%s\nexpected\n%s", out.String(), expected)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("escaped_total", "Line one\nline two.", "value")
+	c.Inc("a \"quoted\" \\ value\n")
+
+	var out bytes.Buffer
+	r.Write(context.Background(), &out)
+	for _, expected := range []string{
+		`# HELP escaped_total Line one\nline two.`,
+		`escaped_total{value="a \"quoted\" \\ value\n"} 1`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Write() =\n%s\nexpected it to contain %s", out.String(), expected)
+		}
+	}
+}
+
+func TestWrongLabelCountPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Inc() with a missing label value did not panic")
+		}
+	}()
+	NewRegistry().NewCounterVec("requests_total", "Requests.", "route", "status").Inc("/users")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("requests_total", "Requests.").Inc()
+
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type: got %s, expected %s", ct, ContentType)
+	}
+	if !strings.Contains(rr.Body.String(), "requests_total 1\n") {
+		t.Errorf("response body: got %s, expected requests_total 1", rr.Body.String())
+	}
+}
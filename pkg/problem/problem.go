@@ -0,0 +1,115 @@
+// Package problem writes error responses as RFC 7807 problem details, so every
+// error of the API has the same shape and a type clients can switch on.
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ContentType is the media type of problem details in JSON
+const ContentType = "application/problem+json"
+
+// Type is a kind of problem, shared by all its occurrences. URI identifies it
+// and Title is a short summary that does not change from one occurrence to the
+// next.
+type Type struct {
+	URI    string
+	Title  string
+	Status int
+}
+
+// New describes an occurrence of t, detail explains this occurrence and
+// instance identifies it
+func (t Type) New(detail, instance string) *Problem {
+	return &Problem{Type: t.URI, Title: t.Title, Status: t.Status, Detail: detail, Instance: instance}
+}
+
+// Problem is a problem details object
+type Problem struct {
+	Type     string
+	Title    string
+	Status   int
+	Detail   string
+	Instance string
+	// Extensions are the additional members of the problem, they cannot
+	// replace the standard ones
+	Extensions map[string]interface{}
+}
+
+// With adds the extension member key to p and returns p
+func (p *Problem) With(key string, value interface{}) *Problem {
+	if p.Extensions == nil {
+		p.Extensions = make(map[string]interface{})
+	}
+	p.Extensions[key] = value
+	return p
+}
+
+// MarshalJSON writes the standard members in the order of the RFC, leaving out
+// the empty ones, followed by the extensions sorted by name
+func (p *Problem) MarshalJSON() ([]byte, error) {
+	standard := []struct {
+		key   string
+		value interface{}
+		empty bool
+	}{
+		{"type", p.Type, p.Type == ""},
+		{"title", p.Title, p.Title == ""},
+		{"status", p.Status, p.Status == 0},
+		{"detail", p.Detail, p.Detail == ""},
+		{"instance", p.Instance, p.Instance == ""},
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	members := 0
+	write := func(key string, value interface{}) error {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		if members > 0 {
+			buf.WriteByte(',')
+		}
+		members++
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+		return nil
+	}
+	reserved := make(map[string]bool, len(standard))
+	for _, member := range standard {
+		reserved[member.key] = true
+		if member.empty {
+			continue
+		}
+		if err := write(member.key, member.value); err != nil {
+			return nil, err
+		}
+	}
+	keys := make([]string, 0, len(p.Extensions))
+	for key := range p.Extensions {
+		if !reserved[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := write(key, p.Extensions[key]); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Write sends p as the response, with its status
+func (p *Problem) Write(w http.ResponseWriter) {
+	body, _ := json.Marshal(p)
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	w.Write(body)
+}
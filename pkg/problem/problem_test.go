@@ -0,0 +1,42 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var notFound = Type{URI: "/problems/not-found", Title: "Not Found", Status: http.StatusNotFound}
+
+func TestMarshalJSON(t *testing.T) {
+	p := notFound.New("no user found", "/user/4").With("request_id", "abc").With("status", 200).With("fields", []string{"name"})
+	body, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"type":"/problems/not-found","title":"Not Found","status":404,"detail":"no user found","instance":"/user/4","fields":["name"],"request_id":"abc"}`
+	if string(body) != expected {
+		t.Errorf("json.Marshal() = %s, expect %s", body, expected)
+	}
+
+	body, _ = json.Marshal(&Problem{Status: http.StatusTeapot})
+	if string(body) != `{"status":418}` {
+		t.Errorf("json.Marshal() = %s, expect empty members left out", body)
+	}
+}
+
+func TestWrite(t *testing.T) {
+	rr := httptest.NewRecorder()
+	notFound.New("", "").Write(rr)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status: got %v, expected %v", rr.Code, http.StatusNotFound)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != ContentType {
+		t.Errorf("Content-Type: got %q, expected %q", contentType, ContentType)
+	}
+	expected := `{"type":"/problems/not-found","title":"Not Found","status":404}`
+	if rr.Body.String() != expected {
+		t.Errorf("body: got %s, expected %s", rr.Body.String(), expected)
+	}
+}
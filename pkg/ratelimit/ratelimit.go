@@ -0,0 +1,185 @@
+// Package ratelimit limits request rates with token buckets kept in Redis, so
+// every replica of the API shares the same buckets.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Limit allows Requests requests per Per on average, in bursts of up to
+// Requests. The zero Limit allows everything.
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseLimit parses limits such as 100/1m, 10/s or 5000/h
+func ParseLimit(s string) (Limit, error) {
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("limit %q is not requests/period such as 100/1m", s)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return Limit{}, fmt.Errorf("limit %q: requests must be a positive integer", s)
+	}
+	period := parts[1]
+	if period != "" && (period[0] < '0' || period[0] > '9') {
+		period = "1" + period
+	}
+	per, err := time.ParseDuration(period)
+	if err != nil || per <= 0 {
+		return Limit{}, fmt.Errorf("limit %q: period must be a positive duration such as 1m", s)
+	}
+	//buckets are refilled by the millisecond
+	if per < time.Millisecond {
+		return Limit{}, fmt.Errorf("limit %q: period must be at least 1ms", s)
+	}
+	return Limit{Requests: requests, Per: per}, nil
+}
+
+func (l Limit) IsZero() bool {
+	return l.Requests == 0
+}
+
+func (l Limit) String() string {
+	if l.IsZero() {
+		return ""
+	}
+	return strconv.Itoa(l.Requests) + "/" + l.Per.String()
+}
+
+func (l Limit) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *Limit) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*l = Limit{}
+		return nil
+	}
+	parsed, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = parsed
+	return nil
+}
+
+// Result is the state of a bucket after a request was counted
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again, RetryAfter how long
+	// until a denied request would be allowed
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// bucketScript refills the bucket of KEYS[1] for the time elapsed since its
+// last use, then takes a token from it if one is left. The time is the one of
+// Redis, so the clocks of the replicas sharing a bucket cannot disagree, unless
+// ARGV[3] gives it in milliseconds. The bucket expires once it would be full
+// again, so idle clients cost no memory. Numbers are passed and stored in
+// plain decimal notation, as not every Lua tonumber reads exponents.
+var bucketScript = redis.NewScript(1, `
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+if not now then
+	--TIME may only be followed by writes once they are replicated as effects
+	redis.replicate_commands()
+	local time = redis.call("TIME")
+	now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+end
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1]) or capacity
+local ts = tonumber(bucket[2]) or now
+if now > ts then
+	tokens = math.min(capacity, tokens + (now - ts) * rate)
+	ts = now
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+tokens = string.format("%.6f", tokens)
+redis.call("HMSET", KEYS[1], "tokens", tokens, "ts", string.format("%d", ts))
+redis.call("PEXPIRE", KEYS[1], string.format("%d", math.ceil((capacity - tonumber(tokens)) / rate) + 1000))
+return {allowed, tokens}
+`)
+
+// keyPrefix is the prefix of the Redis hashes of the buckets
+var keyPrefix = "ratelimit:"
+
+// Limiter counts requests in token buckets stored in Redis
+type Limiter struct {
+	pool *redis.Pool
+	// now replaces the clock of Redis in tests when set
+	now func() time.Time
+}
+
+func NewLimiter(pool *redis.Pool) *Limiter {
+	return &Limiter{pool: pool}
+}
+
+// Allow takes a token from the bucket of key, refilled at the rate of limit,
+// whose period must be at least a millisecond as ParseLimit ensures
+func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (Result, error) {
+	if limit.IsZero() {
+		return Result{Allowed: true}, nil
+	}
+	if limit.Per < time.Millisecond {
+		return Result{}, fmt.Errorf("limit %s: period must be at least 1ms", limit)
+	}
+	conn, err := l.pool.GetContext(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	capacity := float64(limit.Requests)
+	//the rate is computed in nanoseconds, a period is not always whole milliseconds
+	perMillisecond := capacity * float64(time.Millisecond) / float64(limit.Per)
+	args := redis.Args{keyPrefix + key, limit.Requests, strconv.FormatFloat(perMillisecond, 'f', -1, 64)}
+	if l.now != nil {
+		args = args.Add(l.now().UnixNano() / int64(time.Millisecond))
+	}
+	reply, err := redis.Values(bucketScript.Do(conn, args...))
+	if err != nil {
+		return Result{}, err
+	}
+	var allowed int
+	var remaining string
+	if _, err := redis.Scan(reply, &allowed, &remaining); err != nil {
+		return Result{}, err
+	}
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return Result{}, err
+	}
+
+	result := Result{
+		Allowed:   allowed == 1,
+		Limit:     limit.Requests,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     millis((capacity - tokens) / perMillisecond),
+	}
+	if !result.Allowed {
+		result.RetryAfter = millis((1 - tokens) / perMillisecond)
+	}
+	return result, nil
+}
+
+func millis(ms float64) time.Duration {
+	return time.Duration(math.Ceil(ms)) * time.Millisecond
+}
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newLimiter(t *testing.T) (*Limiter, *time.Time, *miniredis.Miniredis) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+	now := time.Unix(1700000000, 0)
+	limiter := NewLimiter(pool)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now, s
+}
+
+func TestParseLimit(t *testing.T) {
+	valid := map[string]Limit{
+		"100/1m": {100, time.Minute},
+		"10/s":   {10, time.Second},
+		"5000/h": {5000, time.Hour},
+		"3/10s":  {3, 10 * time.Second},
+		"2/1ms":  {2, time.Millisecond},
+	}
+	for s, expected := range valid {
+		limit, err := ParseLimit(s)
+		if err != nil || limit != expected {
+			t.Errorf("ParseLimit(%q) = %v, %v, expect %v", s, limit, err, expected)
+		}
+	}
+	for _, s := range []string{"", "100", "0/m", "-1/m", "x/m", "10/", "10/0s", "10/forever", "10/1us", "10/999us", "10/ns"} {
+		if limit, err := ParseLimit(s); err == nil {
+			t.Errorf("ParseLimit(%q) = %v, expected an error", s, limit)
+		}
+	}
+}
+
+func TestAllow(t *testing.T) {
+	limiter, now, _ := newLimiter(t)
+	ctx := context.Background()
+	limit := Limit{Requests: 3, Per: 3 * time.Second}
+
+	for i := 2; i >= 0; i-- {
+		result, err := limiter.Allow(ctx, "client", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != i || result.Limit != 3 {
+			t.Errorf("request %d: Allow() = %+v, expect allowed with %d remaining", 3-i, result, i)
+		}
+	}
+	result, err := limiter.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter != time.Second || result.Reset != 3*time.Second {
+		t.Errorf("exhausted: Allow() = %+v, expect denied, retry after 1s and reset in 3s", result)
+	}
+
+	if other, _ := limiter.Allow(ctx, "other client", limit); !other.Allowed {
+		t.Errorf("other client: Allow() = %+v, expect its own bucket", other)
+	}
+
+	*now = now.Add(1500 * time.Millisecond)
+	result, err = limiter.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 0 {
+		t.Errorf("after 1.5s: Allow() = %+v, expect allowed with half a token left", result)
+	}
+
+	*now = now.Add(time.Hour)
+	result, _ = limiter.Allow(ctx, "client", limit)
+	if result.Remaining != 2 {
+		t.Errorf("after an hour: Allow() = %+v, expect the bucket full again", result)
+	}
+}
+
+func TestAllowSlowRate(t *testing.T) {
+	limiter, now, _ := newLimiter(t)
+	ctx := context.Background()
+	limit := Limit{Requests: 1, Per: time.Hour}
+	if result, err := limiter.Allow(ctx, "client", limit); err != nil || !result.Allowed {
+		t.Fatalf("Allow() = %+v, %v, expect allowed", result, err)
+	}
+	*now = now.Add(time.Second)
+	result, err := limiter.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter != time.Hour-time.Second {
+		t.Errorf("Allow() = %+v, expect denied, retry after 59m59s", result)
+	}
+}
+
+func TestAllowFractionalMilliseconds(t *testing.T) {
+	limiter, now, _ := newLimiter(t)
+	ctx := context.Background()
+	//2 tokens a millisecond, not 3 as a period truncated to 1ms would give
+	limit := Limit{Requests: 3, Per: 1500 * time.Microsecond}
+	for i := 0; i < 3; i++ {
+		if _, err := limiter.Allow(ctx, "client", limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	*now = now.Add(time.Millisecond)
+	result, err := limiter.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 1 {
+		t.Errorf("Allow() = %+v, expect allowed with 1 token left", result)
+	}
+}
+
+func TestAllowShortPeriod(t *testing.T) {
+	limiter, _, _ := newLimiter(t)
+	for _, per := range []time.Duration{0, time.Microsecond, 999 * time.Microsecond} {
+		if result, err := limiter.Allow(context.Background(), "client", Limit{Requests: 10, Per: per}); err == nil {
+			t.Errorf("Allow() period %v = %+v, expected an error", per, result)
+		}
+	}
+}
+
+func TestAllowExpiresIdleBuckets(t *testing.T) {
+	limiter, _, s := newLimiter(t)
+	if _, err := limiter.Allow(context.Background(), "client", Limit{Requests: 10, Per: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	ttl := s.TTL(keyPrefix + "client")
+	if ttl <= 0 || ttl > 2*time.Second {
+		t.Errorf("bucket TTL = %v, expect it to expire about when it is full again", ttl)
+	}
+}
+
+func TestAllowRedisClock(t *testing.T) {
+	limiter, _, s := newLimiter(t)
+	//replicas whose clocks disagree share the clock of Redis
+	limiter.now = nil
+	skewed := *limiter
+	ctx := context.Background()
+	limit := Limit{Requests: 2, Per: 2 * time.Second}
+	start := time.Unix(1700000000, 0)
+	s.SetTime(start)
+	for _, l := range []*Limiter{limiter, &skewed} {
+		if result, err := l.Allow(ctx, "client", limit); err != nil || !result.Allowed {
+			t.Fatalf("Allow() = %+v, %v, expect allowed", result, err)
+		}
+	}
+	result, err := limiter.Allow(ctx, "client", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter != time.Second {
+		t.Errorf("Allow() = %+v, expect denied, retry after 1s of the Redis clock", result)
+	}
+
+	s.SetTime(start.Add(time.Second))
+	if result, err := skewed.Allow(ctx, "client", limit); err != nil || !result.Allowed || result.Remaining != 0 {
+		t.Errorf("after 1s: Allow() = %+v, %v, expect allowed with the token refilled", result, err)
+	}
+}
+
+func TestAllowZeroLimit(t *testing.T) {
+	limiter, _, _ := newLimiter(t)
+	result, err := limiter.Allow(context.Background(), "client", Limit{})
+	if err != nil || !result.Allowed {
+		t.Errorf("Allow() = %+v, %v, expect allowed", result, err)
+	}
+}
@@ -0,0 +1,51 @@
+// Package requestid identifies requests across the client, the server logs and
+// the Redis commands they issue.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Header is the HTTP header carrying the request ID, both ways
+const Header = "X-Request-ID"
+
+// maxLength bounds the IDs accepted from clients, so they cannot flood the logs
+const maxLength = 128
+
+type contextKey struct{}
+
+// New returns a random 128-bit ID in hex
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether an ID sent by a client can be used as is: not empty, at
+// most 128 characters and only visible ASCII
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < '!' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewContext returns a copy of ctx carrying id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the ID stored in ctx by NewContext, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
@@ -0,0 +1,45 @@
+package requestid
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	id := New()
+	if len(id) != 32 || !Valid(id) {
+		t.Errorf("New() = %q, expect 32 hex characters", id)
+	}
+	if other := New(); other == id {
+		t.Errorf("New() returned %q twice", id)
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := map[string]bool{
+		"":                        false,
+		"abc-123":                 true,
+		"0b8c2c1e-3f1a-4c2b-9e77": true,
+		"with space":              false,
+		"new\nline":               false,
+		"café":                    false,
+		strings.Repeat("a", 128):  true,
+		strings.Repeat("a", 129):  false,
+	}
+	for id, expect := range tests {
+		if got := Valid(id); got != expect {
+			t.Errorf("Valid(%q) = %v, expect %v", id, got, expect)
+		}
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if id := FromContext(context.Background()); id != "" {
+		t.Errorf("FromContext() without an ID = %q, expect empty", id)
+	}
+	ctx := NewContext(context.Background(), "abc")
+	if id := FromContext(ctx); id != "abc" {
+		t.Errorf("FromContext() = %q, expect abc", id)
+	}
+}
@@ -0,0 +1,86 @@
+package v1
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// CommandObserver is called after every Redis command sent by a RedisUserStore
+// with its name, its latency and its error if it failed. Pipelined commands
+// are reported as one PIPELINE command when they are flushed.
+type CommandObserver func(command string, latency time.Duration, err error)
+
+// tracer creates a client span for every Redis command, as a child of the span
+// of the request that issued it
+var tracer = otel.Tracer("github.com/rnidev/go-rest/pkg/service/v1")
+
+// instrumentedConn traces and times every command sent with Do, reports it to
+// observe and logs it at debug level with the attributes of the request-scoped
+// logger
+type instrumentedConn struct {
+	redis.Conn
+	ctx     context.Context
+	logger  *slog.Logger
+	observe CommandObserver
+}
+
+func (c instrumentedConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	_, span := tracer.Start(c.ctx, "redis "+commandName(cmd),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system.name", "redis"),
+			attribute.String("db.operation.name", commandName(cmd)),
+		),
+	)
+	start := time.Now()
+	reply, err := c.Conn.Do(cmd, args...)
+	latency := time.Since(start)
+	if err != nil && err != redis.ErrNil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	if c.observe != nil {
+		c.observe(commandName(cmd), latency, err)
+	}
+	if !c.logger.Enabled(c.ctx, slog.LevelDebug) {
+		return reply, err
+	}
+	attrs := []slog.Attr{
+		slog.String("command", commandName(cmd)),
+		slog.Float64("latency_ms", float64(latency)/float64(time.Millisecond)),
+	}
+	//the key is logged but never the values, which may hold user data
+	if key, ok := firstKey(args); ok {
+		attrs = append(attrs, slog.String("key", key))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	c.logger.LogAttrs(c.ctx, slog.LevelDebug, "redis command", attrs...)
+	return reply, err
+}
+
+// commandName names the flush of pipelined commands, which is sent as an empty
+// command
+func commandName(cmd string) string {
+	if cmd == "" {
+		return "PIPELINE"
+	}
+	return cmd
+}
+
+func firstKey(args []interface{}) (string, bool) {
+	if len(args) == 0 {
+		return "", false
+	}
+	key, ok := args[0].(string)
+	return key, ok
+}
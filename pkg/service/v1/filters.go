@@ -0,0 +1,561 @@
+package v1
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// The fields users can be sorted by
+const (
+	SortByID   = "id"
+	SortByName = "name"
+	SortByAge  = "age"
+	SortByCity = "city"
+)
+
+var ErrInvalidSort = errors.New("invalid sort")
+
+// Filter narrows a listing to the users matching every field that is set,
+// City and NamePrefix are compared regardless of case
+type Filter struct {
+	City       string
+	MinAge     *int
+	MaxAge     *int
+	NamePrefix string
+}
+
+// IsZero tells whether f lets every user through
+func (f Filter) IsZero() bool {
+	return f.City == "" && f.MinAge == nil && f.MaxAge == nil && f.NamePrefix == ""
+}
+
+// Matches tells whether user passes f
+func (f Filter) Matches(user *User) bool {
+	if f.City != "" && normalizeCity(user.City) != normalizeCity(f.City) {
+		return false
+	}
+	if f.MinAge != nil && user.Age < *f.MinAge {
+		return false
+	}
+	if f.MaxAge != nil && user.Age > *f.MaxAge {
+		return false
+	}
+	return f.NamePrefix == "" || strings.HasPrefix(normalizeName(user.Name), normalizeName(f.NamePrefix))
+}
+
+// SortField orders users by one of the SortBy fields
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSort reads a comma separated list of fields such as "age,-name", a
+// leading minus sorts that field in descending order
+func ParseSort(s string) ([]SortField, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var fields []SortField
+	for _, name := range strings.Split(s, ",") {
+		field := SortField{Field: strings.TrimPrefix(name, "-")}
+		field.Desc = field.Field != name
+		switch field.Field {
+		case SortByID, SortByName, SortByAge, SortByCity:
+		default:
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidSort, field.Field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// sortUsers orders users by fields. Users that are equal on every field are
+// in the order of the Redis indexes, by their ID as a string, descending when
+// the last field is.
+func sortUsers(users []*User, fields []SortField) {
+	sort.SliceStable(users, func(i, j int) bool {
+		for _, field := range fields {
+			c := compareUsers(users[i], users[j], field.Field)
+			if field.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		c := strings.Compare(strconv.Itoa(users[i].ID), strconv.Itoa(users[j].ID))
+		if len(fields) > 0 && fields[len(fields)-1].Desc {
+			c = -c
+		}
+		return c < 0
+	})
+}
+
+func compareUsers(a, b *User, field string) int {
+	switch field {
+	case SortByName:
+		return strings.Compare(normalizeName(a.Name), normalizeName(b.Name))
+	case SortByAge:
+		return a.Age - b.Age
+	case SortByCity:
+		return strings.Compare(normalizeCity(a.City), normalizeCity(b.City))
+	}
+	return a.ID - b.ID
+}
+
+// listFilteredUsers lists the users passing opts.Filter in the order of
+// opts.Sort. The candidates come from the secondary indexes, and are checked
+// against their hashes since an index may lag behind a hash written without
+// the store.
+func listFilteredUsers(conn redis.Conn, opts ListOptions) (*UserPage, error) {
+	limit := pageLimit(opts.Limit)
+	if len(opts.Sort) > 0 {
+		offset, err := decodeOffsetCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		//the index is only walked when it filters too, the candidates of another
+		//filter are fewer to sort than the index is to walk
+		if r, rest := sortRangeOf(opts.Sort[0].Field, opts.Filter); rest.IsZero() {
+			if len(opts.Sort) == 1 {
+				return pageIndexedUsers(conn, opts.Filter, r, opts.Sort[0].Desc, offset, limit)
+			}
+			return pageTiedUsers(conn, opts, r, offset, limit)
+		}
+		ids, err := filterUserIDs(conn, opts.Filter)
+		if err != nil {
+			return nil, err
+		}
+		return pageSortedUsers(conn, opts, ids, offset, limit)
+	}
+	after, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := filterUserIDs(conn, opts.Filter)
+	if err != nil {
+		return nil, err
+	}
+	return pageFilteredUsers(conn, opts.Filter, ids, after, limit)
+}
+
+// pageFilteredUsers fetches the users after the given ID in batches, until
+// one more than a page passed filter
+func pageFilteredUsers(conn redis.Conn, filter Filter, ids []int, after, limit int) (*UserPage, error) {
+	start := sort.SearchInts(ids, after+1)
+	ids = ids[start:]
+	page := &UserPage{}
+	for len(ids) > 0 && len(page.Users) <= limit {
+		batch := ids[:min(len(ids), limit+1)]
+		ids = ids[len(batch):]
+		users, err := findUsersByIDs(conn, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range users {
+			if filter.Matches(user) {
+				page.Users = append(page.Users, user)
+			}
+		}
+	}
+	if len(page.Users) > limit {
+		page.Users = page.Users[:limit]
+		page.NextCursor = encodeCursor(page.Users[limit-1].ID)
+	}
+	return page, nil
+}
+
+// pageIndexedUsers pages the users sorted by a single field straight from the
+// range r of the index of the field, only reading the members of the page
+func pageIndexedUsers(conn redis.Conn, filter Filter, r sortRange, desc bool, offset, limit int) (*UserPage, error) {
+	ids, err := r.ids(conn, desc, offset, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	page := &UserPage{}
+	if len(ids) > limit {
+		ids = ids[:limit]
+		page.NextCursor = encodeOffsetCursor(offset + limit)
+	}
+	users, err := findUsersByIDs(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if filter.Matches(user) {
+			page.Users = append(page.Users, user)
+		}
+	}
+	return page, nil
+}
+
+// pageTiedUsers pages the users sorted by several fields from the range r of
+// the index of the first field. The users tied on the first field are next to
+// each other in the index, so only the ties the page overlaps are read and
+// sorted on the other fields. The index is watched from the values of the page
+// to the ties, which are read with MULTI/EXEC, so a user moved in the index
+// between the two reads makes them start over rather than disagree.
+func pageTiedUsers(conn redis.Conn, opts ListOptions, r sortRange, offset, limit int) (*UserPage, error) {
+	desc := opts.Sort[0].Desc
+	for i := 0; i < maxTxRetries; i++ {
+		if _, err := conn.Do("WATCH", r.key); err != nil {
+			return nil, err
+		}
+		values, err := r.values(conn, desc, offset, limit+1)
+		if err != nil || len(values) == 0 {
+			conn.Do("UNWATCH")
+			return &UserPage{}, err
+		}
+		page := &UserPage{}
+		if len(values) > limit {
+			values = values[:limit]
+			page.NextCursor = encodeOffsetCursor(offset + limit)
+		}
+		tx := r.ties(desc, values[0], values[len(values)-1])
+		replies, err := tx.exec(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(replies) != len(tx) {
+			continue
+		}
+		before, ids, err := scanTies(replies, desc)
+		if err != nil {
+			return nil, err
+		}
+		return pageTies(conn, opts, page, ids, offset-before, limit)
+	}
+	return nil, ErrTooManyConflicts
+}
+
+// pageTies fills page with limit of the users tied on the first field they are
+// sorted by from start, once sorted on the other fields
+func pageTies(conn redis.Conn, opts ListOptions, page *UserPage, ids []int, start, limit int) (*UserPage, error) {
+	users, err := findSortFields(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	sortUsers(users, opts.Sort)
+	//the ties may lag behind the hashes, which leave out deleted users
+	start = max(0, min(start, len(users)))
+	users = users[start:min(start+limit, len(users))]
+	sorted := make([]int, len(users))
+	for i, user := range users {
+		sorted[i] = user.ID
+	}
+	found, err := findUsersByIDs(conn, sorted)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range found {
+		if opts.Filter.Matches(user) {
+			page.Users = append(page.Users, user)
+		}
+	}
+	return page, nil
+}
+
+// sortRange is a range of the index users are sorted by, its bounds are those
+// of ZRANGEBYLEX when byLex is set and of ZRANGEBYSCORE otherwise
+type sortRange struct {
+	key      string
+	byLex    bool
+	from, to string
+}
+
+// sortRangeOf returns the range of the index of field that the filter on field
+// leaves, and the rest of filter
+func sortRangeOf(field string, filter Filter) (sortRange, Filter) {
+	switch field {
+	case SortByAge:
+		r := sortRange{key: ageIndexKey, from: "-inf", to: "+inf"}
+		if filter.MinAge != nil {
+			r.from = strconv.Itoa(*filter.MinAge)
+		}
+		if filter.MaxAge != nil {
+			r.to = strconv.Itoa(*filter.MaxAge)
+		}
+		filter.MinAge, filter.MaxAge = nil, nil
+		return r, filter
+	case SortByName:
+		r := sortRange{key: nameIndexKey, byLex: true, from: "-", to: "+"}
+		if filter.NamePrefix != "" {
+			prefix := normalizeName(filter.NamePrefix)
+			r.from, r.to = "["+prefix, "["+prefix+"\xff"
+			filter.NamePrefix = ""
+		}
+		return r, filter
+	case SortByCity:
+		r := sortRange{key: cityIndexKey, byLex: true, from: "-", to: "+"}
+		if filter.City != "" {
+			city := normalizeCity(filter.City)
+			r.from, r.to = "["+city+"\x00", "["+city+"\x00\xff"
+			filter.City = ""
+		}
+		return r, filter
+	}
+	return sortRange{key: userIndexKey, from: "-inf", to: "+inf"}, filter
+}
+
+// ids reads the IDs of count members of r from offset, in descending order
+// when desc is set
+func (r sortRange) ids(conn redis.Conn, desc bool, offset, count int) ([]int, error) {
+	cmd, from, to := "ZRANGEBYSCORE", r.from, r.to
+	if r.byLex {
+		cmd = "ZRANGEBYLEX"
+	}
+	if desc {
+		cmd, from, to = strings.Replace(cmd, "ZRANGE", "ZREVRANGE", 1), to, from
+	}
+	members, err := redis.Strings(conn.Do(cmd, r.key, from, to, "LIMIT", offset, count))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, len(members))
+	for i, member := range members {
+		if ids[i], err = indexMemberID(member); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// values reads the values users are sorted by of count members of r from
+// offset, in descending order when desc is set: the scores of a sorted set by
+// score, the part before the ID of the members of one by lex
+func (r sortRange) values(conn redis.Conn, desc bool, offset, count int) ([]string, error) {
+	cmd, from, to := "ZRANGEBYSCORE", r.from, r.to
+	if r.byLex {
+		cmd = "ZRANGEBYLEX"
+	}
+	if desc {
+		cmd, from, to = strings.Replace(cmd, "ZRANGE", "ZREVRANGE", 1), to, from
+	}
+	args := redis.Args{r.key, from, to}
+	if !r.byLex {
+		args = args.Add("WITHSCORES")
+	}
+	reply, err := redis.Strings(conn.Do(cmd, args.Add("LIMIT", offset, count)...))
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	if !r.byLex {
+		for i := 1; i < len(reply); i += 2 {
+			values = append(values, reply[i])
+		}
+		return values, nil
+	}
+	for _, member := range reply {
+		values = append(values, member[:strings.LastIndexByte(member, 0)])
+	}
+	return values, nil
+}
+
+// ties reads the IDs of the members of r with a value from first to last,
+// along with the number of members of r before them in the order of desc.
+// Its replies are scanned by scanTies.
+func (r sortRange) ties(desc bool, first, last string) transaction {
+	lo, hi := first, last
+	if desc {
+		lo, hi = last, first
+	}
+	//the members before the ties are counted as those of r up to the first
+	//value, less the ones up to and with it when descending
+	countCmd, rangeCmd := "ZCOUNT", "ZRANGEBYSCORE"
+	from, to, upTo, through := lo, hi, "("+first, first
+	if r.byLex {
+		countCmd, rangeCmd = "ZLEXCOUNT", "ZRANGEBYLEX"
+		from, to, upTo, through = "["+lo+"\x00", "["+hi+"\x00\xff", "("+first+"\x00", "["+first+"\x00\xff"
+	}
+	var tx transaction
+	tx.add(rangeCmd, r.key, from, to)
+	if desc {
+		tx.add(countCmd, r.key, r.from, r.to)
+		tx.add(countCmd, r.key, r.from, through)
+	} else {
+		tx.add(countCmd, r.key, r.from, upTo)
+	}
+	return tx
+}
+
+// scanTies scans the replies of sortRange.ties
+func scanTies(replies []interface{}, desc bool) (int, []int, error) {
+	members, err := redis.Strings(replies[0], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	before, err := redis.Int(replies[1], nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	if desc {
+		through, err := redis.Int(replies[2], nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		before -= through
+	}
+	ids := make([]int, len(members))
+	for i, member := range members {
+		if ids[i], err = indexMemberID(member); err != nil {
+			return 0, nil, err
+		}
+	}
+	return before, ids, nil
+}
+
+// pageSortedUsers is for the sorts filtered by another field than the first
+// sorted one. It sorts the candidates of the filter on the fields they are
+// sorted and filtered by, then fetches the page starting at offset.
+func pageSortedUsers(conn redis.Conn, opts ListOptions, ids []int, offset, limit int) (*UserPage, error) {
+	candidates, err := findSortFields(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, user := range candidates {
+		if opts.Filter.Matches(user) {
+			users = append(users, user)
+		}
+	}
+	sortUsers(users, opts.Sort)
+	page := &UserPage{}
+	if offset >= len(users) {
+		return page, nil
+	}
+	users = users[offset:]
+	if len(users) > limit {
+		users = users[:limit]
+		page.NextCursor = encodeOffsetCursor(offset + limit)
+	}
+	sorted := make([]int, len(users))
+	for i, user := range users {
+		sorted[i] = user.ID
+	}
+	page.Users, err = findUsersByIDs(conn, sorted)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// findSortFields reads the fields users are sorted and filtered by of the given
+// users in a single pipelined round trip, deleted users are left out
+func findSortFields(conn redis.Conn, ids []int) ([]*User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	for _, id := range ids {
+		if err := conn.Send("HMGET", userKeyPrefix+strconv.Itoa(id), deletedAtField, "name", "age", "city"); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	for i, reply := range replies {
+		fields, err := redis.Strings(reply, nil)
+		if err != nil || fields[0] != "" {
+			continue
+		}
+		age, _ := strconv.Atoi(fields[2])
+		users = append(users, &User{ID: ids[i], Name: fields[1], Age: age, City: fields[3]})
+	}
+	return users, nil
+}
+
+// filterUserIDs intersects the indexes of the fields filter sets, every user
+// is a candidate when it sets none. The IDs are in ascending order.
+func filterUserIDs(conn redis.Conn, filter Filter) ([]int, error) {
+	sent := 0
+	if filter.City != "" {
+		if err := conn.Send("SMEMBERS", cityIndexKeyPrefix+normalizeCity(filter.City)); err != nil {
+			return nil, err
+		}
+		sent++
+	}
+	if filter.MinAge != nil || filter.MaxAge != nil {
+		from, to := "-inf", "+inf"
+		if filter.MinAge != nil {
+			from = strconv.Itoa(*filter.MinAge)
+		}
+		if filter.MaxAge != nil {
+			to = strconv.Itoa(*filter.MaxAge)
+		}
+		if err := conn.Send("ZRANGEBYSCORE", ageIndexKey, from, to); err != nil {
+			return nil, err
+		}
+		sent++
+	}
+	if filter.NamePrefix != "" {
+		prefix := normalizeName(filter.NamePrefix)
+		if err := conn.Send("ZRANGEBYLEX", nameIndexKey, "["+prefix, "["+prefix+"\xff"); err != nil {
+			return nil, err
+		}
+		sent++
+	}
+	if sent == 0 {
+		return redis.Ints(conn.Do("ZRANGE", userIndexKey, 0, -1))
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for i, reply := range replies {
+		members, err := redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		matched := make([]int, 0, len(members))
+		for _, member := range members {
+			id, err := indexMemberID(member)
+			if err != nil {
+				return nil, err
+			}
+			matched = append(matched, id)
+		}
+		sort.Ints(matched)
+		if i == 0 {
+			ids = matched
+		} else {
+			ids = intersectIDs(ids, matched)
+		}
+	}
+	return ids, nil
+}
+
+// indexMemberID returns the ID of a member of an index, the members of the name
+// index are ordered by name and end with the ID
+func indexMemberID(member string) (int, error) {
+	id, err := strconv.Atoi(member[strings.LastIndexByte(member, 0)+1:])
+	if err != nil {
+		return 0, fmt.Errorf("invalid index member %q: %w", member, err)
+	}
+	return id, nil
+}
+
+// intersectIDs returns the IDs in both a and b, which are in ascending order
+func intersectIDs(a, b []int) []int {
+	var ids []int
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			ids = append(ids, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return ids
+}
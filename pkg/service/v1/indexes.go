@@ -0,0 +1,184 @@
+package v1
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// emailKeyPrefix is followed by a normalized email for the ID of the user
+	// with it, one key per email so a write only watches the emails it changes
+	emailKeyPrefix = "users:email:"
+	// ageIndexKey is a sorted set of every user ID, scored by the age
+	ageIndexKey = "users:age"
+	// cityIndexKeyPrefix is followed by a normalized city for the set of the
+	// IDs of its users
+	cityIndexKeyPrefix = "users:city:"
+	// nameIndexKey is a sorted set of nameIndexMember of every user, all
+	// scored 0 so it is ordered by name
+	nameIndexKey = "users:name"
+	// cityIndexKey is a sorted set of cityIndexMember of every user, all
+	// scored 0 so it is ordered by city
+	cityIndexKey = "users:cities"
+)
+
+var ErrEmailTaken = errors.New("email is already taken")
+
+// updateIndexes queues the changes to the secondary indexes of a user going
+// from before to after, before is nil for a new user and after for a deleted
+// one. It is called inside watch, before MULTI, so it can watch and read the
+// indexes it has to check.
+func updateIndexes(conn redis.Conn, tx *transaction, userID int, before, after *User) error {
+	if err := updateEmailIndex(conn, tx, userID, before, after); err != nil {
+		return err
+	}
+	updateFilterIndexes(tx, userID, before, after)
+	updateSearchIndex(tx, userID, before, after)
+	updateStats(tx, userID, before, after)
+	return nil
+}
+
+// updateFilterIndexes moves the user in the indexes of the fields users are
+// filtered by, they do not have to be checked so nothing is watched
+func updateFilterIndexes(tx *transaction, userID int, before, after *User) {
+	if before != nil && (after == nil || before.Age != after.Age) {
+		tx.add("ZREM", ageIndexKey, userID)
+	}
+	if after != nil && (before == nil || before.Age != after.Age) {
+		tx.add("ZADD", ageIndexKey, after.Age, userID)
+	}
+	var oldCity, newCity, oldName, newName string
+	if before != nil {
+		oldCity, oldName = normalizeCity(before.City), nameIndexMember(before.Name, userID)
+	}
+	if after != nil {
+		newCity, newName = normalizeCity(after.City), nameIndexMember(after.Name, userID)
+	}
+	if oldCity != newCity {
+		if oldCity != "" {
+			tx.add("SREM", cityIndexKeyPrefix+oldCity, userID)
+		}
+		if newCity != "" {
+			tx.add("SADD", cityIndexKeyPrefix+newCity, userID)
+		}
+	}
+	//users without a city are in the city index too, they sort first
+	if before == nil || after == nil || oldCity != newCity {
+		if before != nil {
+			tx.add("ZREM", cityIndexKey, cityIndexMember(before.City, userID))
+		}
+		if after != nil {
+			tx.add("ZADD", cityIndexKey, 0, cityIndexMember(after.City, userID))
+		}
+	}
+	if oldName != newName {
+		if oldName != "" {
+			tx.add("ZREM", nameIndexKey, oldName)
+		}
+		if newName != "" {
+			tx.add("ZADD", nameIndexKey, 0, newName)
+		}
+	}
+}
+
+// updateEmailIndex moves the user to its new email in the index, failing with
+// ErrEmailTaken when another user has it
+func updateEmailIndex(conn redis.Conn, tx *transaction, userID int, before, after *User) error {
+	var oldEmail, newEmail string
+	if before != nil {
+		oldEmail = normalizeEmail(before.Email)
+	}
+	if after != nil {
+		newEmail = normalizeEmail(after.Email)
+	}
+	if oldEmail == newEmail {
+		return nil
+	}
+	var keys redis.Args
+	for _, email := range []string{oldEmail, newEmail} {
+		if email != "" {
+			keys = keys.Add(emailKeyPrefix + email)
+		}
+	}
+	if _, err := conn.Do("WATCH", keys...); err != nil {
+		return err
+	}
+	if newEmail != "" {
+		owner, err := emailOwner(conn, newEmail)
+		if err != nil {
+			return err
+		}
+		if owner != 0 && owner != userID {
+			return ErrEmailTaken
+		}
+		tx.add("SET", emailKeyPrefix+newEmail, userID)
+	}
+	if oldEmail != "" {
+		owner, err := emailOwner(conn, oldEmail)
+		if err != nil {
+			return err
+		}
+		//the entry is left alone if it was taken by another user
+		if owner == userID {
+			tx.add("DEL", emailKeyPrefix+oldEmail)
+		}
+	}
+	return nil
+}
+
+// emailOwner returns the ID of the user with email in the index, 0 if none
+func emailOwner(conn redis.Conn, email string) (int, error) {
+	id, err := redis.Int(conn.Do("GET", emailKeyPrefix+email))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	return id, err
+}
+
+// normalizeEmail is the form of email kept in the index, emails differing only
+// by case are the same
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeCity is the form of city kept in the index, cities differing only
+// by case are the same
+func normalizeCity(city string) string {
+	return strings.ToLower(strings.TrimSpace(city))
+}
+
+// normalizeName is the form of name users are filtered and sorted by
+func normalizeName(name string) string {
+	return strings.ToLower(name)
+}
+
+// nameIndexMember is the member of a user in the name index, the name comes
+// first for the order and the ID after a NUL byte to tell users apart
+func nameIndexMember(name string, userID int) string {
+	return normalizeName(name) + "\x00" + strconv.Itoa(userID)
+}
+
+// cityIndexMember is the member of a user in the city index, laid out like
+// nameIndexMember
+func cityIndexMember(city string, userID int) string {
+	return normalizeCity(city) + "\x00" + strconv.Itoa(userID)
+}
+
+// FindUserByEmail finds the user with email, compared regardless of case
+func FindUserByEmail(conn redis.Conn, email string) (*User, error) {
+	email = normalizeEmail(email)
+	if email == "" {
+		return nil, ErrNoUserFound
+	}
+	id, err := emailOwner(conn, email)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		return nil, ErrNoUserFound
+	}
+	return FindUserByID(conn, id)
+}
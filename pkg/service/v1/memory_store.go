@@ -0,0 +1,242 @@
+package v1
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore is an in-process UserStore, meant for tests and local development
+type MemoryUserStore struct {
+	mu     sync.RWMutex
+	users  map[int]User
+	lastID int
+	//deleted holds the IDs of soft-deleted users, which stay in users until purged
+	deleted map[int]bool
+}
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{users: make(map[int]User), deleted: make(map[int]bool)}
+}
+
+func (s *MemoryUserStore) ListAllUsers(ctx context.Context) ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var users []*User
+	for _, user := range s.users {
+		if s.deleted[user.ID] {
+			continue
+		}
+		user := user
+		user.Attributes = copyAttributes(user.Attributes)
+		users = append(users, &user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *MemoryUserStore) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	//sorted pages are cursored by offset, like in the Redis store
+	decode := decodeCursor
+	if len(opts.Sort) > 0 {
+		decode = decodeOffsetCursor
+	}
+	after, err := decode(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := pageLimit(opts.Limit)
+	all, err := s.ListAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var users []*User
+	for _, user := range all {
+		if opts.Filter.Matches(user) {
+			users = append(users, user)
+		}
+	}
+	page := &UserPage{}
+	if len(opts.Sort) > 0 {
+		sortUsers(users, opts.Sort)
+		users = users[min(after, len(users)):]
+		if len(users) > limit {
+			users = users[:limit]
+			page.NextCursor = encodeOffsetCursor(after + limit)
+		}
+	} else {
+		start := sort.Search(len(users), func(i int) bool { return users[i].ID > after })
+		users = users[start:]
+		if len(users) > limit {
+			users = users[:limit]
+			page.NextCursor = encodeCursor(users[limit-1].ID)
+		}
+	}
+	if len(users) > 0 {
+		page.Users = users
+	}
+	return page, nil
+}
+
+func (s *MemoryUserStore) CountUsers(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users) - len(s.deleted), nil
+}
+
+// UserStats sums up every user, the memory store has no counters to keep
+func (s *MemoryUserStore) UserStats(ctx context.Context) (*Stats, error) {
+	users, err := s.ListAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return statsOf(users), nil
+}
+
+func (s *MemoryUserStore) FindUserByID(ctx context.Context, userID int) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[userID]
+	if !ok || s.deleted[userID] {
+		return nil, ErrNoUserFound
+	}
+	user.Attributes = copyAttributes(user.Attributes)
+	return &user, nil
+}
+
+func (s *MemoryUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id := s.emailOwner(email)
+	if id == 0 {
+		return nil, ErrNoUserFound
+	}
+	user := s.users[id]
+	user.Attributes = copyAttributes(user.Attributes)
+	return &user, nil
+}
+
+// SearchUsers scores every user, the memory store has no index to narrow them
+func (s *MemoryUserStore) SearchUsers(ctx context.Context, query string, limit int) ([]*SearchResult, error) {
+	users, err := s.ListAllUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	terms := searchTerms(query)
+	var results []*SearchResult
+	for _, user := range users {
+		if result, ok := matchUser(user, terms); ok {
+			results = append(results, result)
+		}
+	}
+	return rankResults(results, pageLimit(limit)), nil
+}
+
+// emailOwner returns the ID of the user that is not deleted with email, 0 if
+// none, s.mu must be held
+func (s *MemoryUserStore) emailOwner(email string) int {
+	email = normalizeEmail(email)
+	if email == "" {
+		return 0
+	}
+	for id, user := range s.users {
+		if !s.deleted[id] && normalizeEmail(user.Email) == email {
+			return id
+		}
+	}
+	return 0
+}
+
+func (s *MemoryUserStore) CreateOrUpdateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	//check input user.ID to either create or update
+	if user.ID > 0 {
+		updated, err := s.update(user.ID, func(current *User) error {
+			if user.Version > 0 && user.Version != current.Version {
+				return ErrVersionMismatch
+			}
+			*current = *user
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		user.Version = updated.Version
+		return nil
+	}
+	if s.emailOwner(user.Email) != 0 {
+		return ErrEmailTaken
+	}
+	s.lastID++
+	user.ID = s.lastID
+	user.Version = 1
+	user.CreatedAt = timestamp(time.Now())
+	user.UpdatedAt = user.CreatedAt
+	stored := *user
+	stored.Attributes = copyAttributes(user.Attributes)
+	s.users[user.ID] = stored
+	return nil
+}
+
+func (s *MemoryUserStore) UpdateUser(ctx context.Context, userID int, fn func(user *User) error) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(userID, fn)
+}
+
+// update mirrors UpdateUser of the Redis store, s.mu must be held
+func (s *MemoryUserStore) update(userID int, fn func(user *User) error) (*User, error) {
+	current, ok := s.users[userID]
+	if !ok || s.deleted[userID] {
+		return nil, ErrNoUserFound
+	}
+	user := current
+	user.Attributes = copyAttributes(current.Attributes)
+	if err := fn(&user); err != nil {
+		return nil, err
+	}
+	user.ID = current.ID
+	user.Version = current.Version
+	user.CreatedAt = current.CreatedAt
+	user.UpdatedAt = current.UpdatedAt
+	if owner := s.emailOwner(user.Email); owner != 0 && owner != userID {
+		return nil, ErrEmailTaken
+	}
+	if len(changedFields(&current, &user)) > 0 || !sameAttributes(current.Attributes, user.Attributes) {
+		user.Version++
+		user.UpdatedAt = timestamp(time.Now())
+	}
+	stored := user
+	stored.Attributes = copyAttributes(user.Attributes)
+	s.users[userID] = stored
+	return &user, nil
+}
+
+func (s *MemoryUserStore) DeleteUser(ctx context.Context, userID int, opts DeleteOptions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrNoUserFound
+	}
+	if opts.Soft && s.deleted[userID] {
+		return ErrNoUserFound
+	}
+	if !opts.matchVersion(user.Version) {
+		return ErrVersionMismatch
+	}
+	if opts.Soft {
+		s.deleted[userID] = true
+		return nil
+	}
+	delete(s.users, userID)
+	delete(s.deleted, userID)
+	return nil
+}
@@ -0,0 +1,125 @@
+package v1
+
+import (
+	"context"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/logging"
+)
+
+// RedisUserStore is a UserStore backed by Redis hashes, one connection is taken
+// from the pool per call and returned once the call is done
+type RedisUserStore struct {
+	pool    *redis.Pool
+	observe CommandObserver
+}
+
+func NewRedisUserStore(pool *redis.Pool) *RedisUserStore {
+	return &RedisUserStore{pool: pool}
+}
+
+// ObserveCommands sets the function told about every Redis command the store
+// sends, it must be set before the store is used
+func (s *RedisUserStore) ObserveCommands(observe CommandObserver) {
+	s.observe = observe
+}
+
+// conn takes a connection from the pool that reports its commands to the
+// observer and logs them with the logger of ctx
+func (s *RedisUserStore) conn(ctx context.Context) (redis.Conn, error) {
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{Conn: conn, ctx: ctx, logger: logging.FromContext(ctx), observe: s.observe}, nil
+}
+
+func (s *RedisUserStore) ListAllUsers(ctx context.Context) ([]*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ListAllUsers(conn)
+}
+
+func (s *RedisUserStore) ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return ListUsers(conn, opts)
+}
+
+func (s *RedisUserStore) CountUsers(ctx context.Context) (int, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return CountUsers(conn)
+}
+
+func (s *RedisUserStore) UserStats(ctx context.Context) (*Stats, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return UserStats(conn)
+}
+
+func (s *RedisUserStore) FindUserByID(ctx context.Context, userID int) (*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return FindUserByID(conn, userID)
+}
+
+func (s *RedisUserStore) FindUserByEmail(ctx context.Context, email string) (*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return FindUserByEmail(conn, email)
+}
+
+func (s *RedisUserStore) SearchUsers(ctx context.Context, query string, limit int) ([]*SearchResult, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return SearchUsers(conn, query, limit)
+}
+
+func (s *RedisUserStore) CreateOrUpdateUser(ctx context.Context, user *User) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return CreateOrUpdateUser(conn, user)
+}
+
+func (s *RedisUserStore) UpdateUser(ctx context.Context, userID int, fn func(user *User) error) (*User, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return UpdateUser(conn, userID, fn)
+}
+
+func (s *RedisUserStore) DeleteUser(ctx context.Context, userID int, opts DeleteOptions) error {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return DeleteUser(conn, userID, opts)
+}
@@ -0,0 +1,422 @@
+package v1
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// searchKeyPrefix is followed by a term for a sorted set of the IDs of the
+	// users with a word starting with it, scored by how well the term matches
+	searchKeyPrefix = "users:search:"
+	// wordKeyPrefix is followed by a word for a sorted set of the IDs of the
+	// users with it, scored by the weight of the field it is in
+	wordKeyPrefix = "users:words:"
+	// typoKeyPrefix is followed by a word, or the word with one letter left
+	// out, for the set of the indexed words it may be a typo of
+	typoKeyPrefix = "users:typos:"
+	// searchTempKeyPrefix is followed by the index of a term for the scores of
+	// the users matching it, the keys only live inside the MULTI of a search
+	searchTempKeyPrefix = "users:searchtmp:"
+)
+
+const (
+	// minPrefixLength is the shortest prefix of a word it is found by, a
+	// shorter term is only looked up as a whole word. Shorter prefixes are
+	// shared by too many users to be worth indexing.
+	minPrefixLength = 3
+	// minTypoLength is the shortest term looked up with a typo, shorter
+	// terms have too many words one letter away
+	minTypoLength = 4
+	// typoPenalty scales the score of a word found with a typo
+	typoPenalty = 0.5
+)
+
+// SearchResult is a user matching a search, Highlights has the value of each
+// field that matched, HTML escaped with the matches between <em> and </em>
+type SearchResult struct {
+	User       *User
+	Score      float64
+	Highlights map[string]string
+}
+
+// searchField is a field of the user searched, a match in a field of greater
+// weight ranks higher
+type searchField struct {
+	name   string
+	value  string
+	weight float64
+}
+
+func searchFields(user *User) []searchField {
+	return []searchField{
+		{"name", user.Name, 2},
+		{"city", user.City, 1},
+	}
+}
+
+// token is a lowercased word of a field, start and end are its byte offsets
+// in the field
+type token struct {
+	word       string
+	start, end int
+}
+
+// tokenize splits s into its words, runs of letters and digits
+func tokenize(s string) []token {
+	var tokens []token
+	var word strings.Builder
+	start := -1
+	for i, r := range s + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			word.WriteRune(unicode.ToLower(r))
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{word.String(), start, i})
+			word.Reset()
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// searchTerms splits a query into its distinct lowercased words
+func searchTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, t := range tokenize(query) {
+		if !seen[t.word] {
+			seen[t.word] = true
+			terms = append(terms, t.word)
+		}
+	}
+	return terms
+}
+
+// prefixScore is the score of a word matched by a prefix of n of its runes,
+// a whole word is worth the weight of its field
+func prefixScore(weight float64, n int, word string) float64 {
+	return weight * float64(n) / float64(utf8.RuneCountInString(word))
+}
+
+// userTerms maps every prefix a user is found by to its best score
+func userTerms(user *User) map[string]float64 {
+	terms := make(map[string]float64)
+	for _, field := range searchFields(user) {
+		for _, t := range tokenize(field.value) {
+			runes := []rune(t.word)
+			for n := minPrefixLength; n <= len(runes); n++ {
+				term := string(runes[:n])
+				if score := prefixScore(field.weight, n, t.word); score > terms[term] {
+					terms[term] = score
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// userWords maps every word of a user to the weight of the best field it is in
+func userWords(user *User) map[string]float64 {
+	words := make(map[string]float64)
+	for _, field := range searchFields(user) {
+		for _, t := range tokenize(field.value) {
+			words[t.word] = max(words[t.word], field.weight)
+		}
+	}
+	return words
+}
+
+// typoVariants returns word and every way of leaving one of its runes out. Two
+// words one edit apart share a variant, which finds typos without comparing
+// the term to every word.
+func typoVariants(word string) []string {
+	runes := []rune(word)
+	variants := []string{word}
+	for i := range runes {
+		variants = append(variants, string(runes[:i])+string(runes[i+1:]))
+	}
+	return variants
+}
+
+// isTypo tells whether a and b differ by exactly one inserted, deleted,
+// replaced or swapped rune
+func isTypo(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < len(rb) {
+		ra, rb = rb, ra
+	}
+	i := 0
+	for i < len(rb) && ra[i] == rb[i] {
+		i++
+	}
+	switch len(ra) - len(rb) {
+	case 0:
+		if i == len(ra) {
+			return false
+		}
+		if string(ra[i+1:]) == string(rb[i+1:]) {
+			return true
+		}
+		return i+1 < len(ra) && ra[i] == rb[i+1] && ra[i+1] == rb[i] && string(ra[i+2:]) == string(rb[i+2:])
+	case 1:
+		return string(ra[i+1:]) == string(rb[i:])
+	}
+	return false
+}
+
+// matchUser scores user against every term of a search, a user must match
+// them all. Each term counts by its best match, as a prefix of a word or else
+// as a typo of a whole word.
+func matchUser(user *User, terms []string) (*SearchResult, bool) {
+	if len(terms) == 0 {
+		return nil, false
+	}
+	fields := searchFields(user)
+	//the matched runes of each token of each field, to highlight
+	matched := make([][]int, len(fields))
+	tokens := make([][]token, len(fields))
+	for i, field := range fields {
+		tokens[i] = tokenize(field.value)
+		matched[i] = make([]int, len(tokens[i]))
+	}
+	result := &SearchResult{User: user}
+	for _, term := range terms {
+		n := utf8.RuneCountInString(term)
+		best := 0.0
+		for i, field := range fields {
+			for j, t := range tokens[i] {
+				score := 0.0
+				switch {
+				case strings.HasPrefix(t.word, term) && (n >= minPrefixLength || term == t.word):
+					score = prefixScore(field.weight, n, t.word)
+					matched[i][j] = max(matched[i][j], n)
+				case n >= minTypoLength && isTypo(term, t.word):
+					score = field.weight * typoPenalty
+					matched[i][j] = utf8.RuneCountInString(t.word)
+				}
+				best = max(best, score)
+			}
+		}
+		if best == 0 {
+			return nil, false
+		}
+		result.Score += best
+	}
+	result.Highlights = make(map[string]string)
+	for i, field := range fields {
+		if highlight, ok := highlightField(field.value, tokens[i], matched[i]); ok {
+			result.Highlights[field.name] = highlight
+		}
+	}
+	return result, true
+}
+
+// highlightField escapes value and puts the first matched runes of its
+// tokens between <em> and </em>
+func highlightField(value string, tokens []token, matched []int) (string, bool) {
+	var b strings.Builder
+	last := 0
+	for i, t := range tokens {
+		if matched[i] == 0 {
+			continue
+		}
+		end := t.start
+		for n := 0; n < matched[i] && end < t.end; n++ {
+			_, size := utf8.DecodeRuneInString(value[end:])
+			end += size
+		}
+		b.WriteString(html.EscapeString(value[last:t.start]))
+		b.WriteString("<em>" + html.EscapeString(value[t.start:end]) + "</em>")
+		last = end
+	}
+	if last == 0 {
+		return "", false
+	}
+	b.WriteString(html.EscapeString(value[last:]))
+	return b.String(), true
+}
+
+// rankResults orders results by descending score, then by ID, and keeps the
+// first limit
+func rankResults(results []*SearchResult, limit int) []*SearchResult {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].User.ID < results[j].User.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// updateSearchIndex moves the user to the prefixes and words of its new name
+// and city. The typo index only maps words to words, a word that is no longer
+// used is left in it and simply finds nobody.
+func updateSearchIndex(tx *transaction, userID int, before, after *User) {
+	var oldTerms, newTerms, oldWords, newWords map[string]float64
+	if before != nil {
+		oldTerms, oldWords = userTerms(before), userWords(before)
+	}
+	if after != nil {
+		newTerms, newWords = userTerms(after), userWords(after)
+	}
+	updateScores(tx, searchKeyPrefix, userID, oldTerms, newTerms)
+	updateScores(tx, wordKeyPrefix, userID, oldWords, newWords)
+	for _, word := range sortedKeys(newWords) {
+		if _, ok := oldWords[word]; ok {
+			continue
+		}
+		for _, variant := range typoVariants(word) {
+			tx.add("SADD", typoKeyPrefix+variant, word)
+		}
+	}
+}
+
+// updateScores queues the changes to the sorted sets of the user, named by
+// keyPrefix and the terms, going from the old scores to the new ones
+func updateScores(tx *transaction, keyPrefix string, userID int, old, new map[string]float64) {
+	for _, term := range sortedKeys(old) {
+		if _, ok := new[term]; !ok {
+			tx.add("ZREM", keyPrefix+term, userID)
+		}
+	}
+	for _, term := range sortedKeys(new) {
+		if score, ok := old[term]; !ok || score != new[term] {
+			tx.add("ZADD", keyPrefix+term, new[term], userID)
+		}
+	}
+}
+
+// sortedKeys returns the keys of terms in order, so the commands queued for
+// them are the same on every run
+func sortedKeys(terms map[string]float64) []string {
+	keys := make([]string, 0, len(terms))
+	for key := range terms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SearchUsers finds the users matching every word of query in their name or
+// city, best matches first. The candidates are scored and ranked by the index
+// in Redis, then the first limit are fetched and scored against their hashes.
+func SearchUsers(conn redis.Conn, query string, limit int) ([]*SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, nil
+	}
+	limit = pageLimit(limit)
+	ids, err := rankCandidates(conn, terms, limit)
+	if err != nil {
+		return nil, err
+	}
+	users, err := findUsersByIDs(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	var results []*SearchResult
+	for _, user := range users {
+		if result, ok := matchUser(user, terms); ok {
+			results = append(results, result)
+		}
+	}
+	return rankResults(results, limit), nil
+}
+
+// rankCandidates returns the IDs of the limit users scoring best on every term.
+// Each term is scored by the best of its sorted sets, the terms are summed
+// over the users matching them all, and only the best are read back. It runs
+// in a MULTI so the temporary keys are never seen, or left behind.
+func rankCandidates(conn redis.Conn, terms []string, limit int) ([]int, error) {
+	var tx transaction
+	termKeys := make([]string, len(terms))
+	for i, term := range terms {
+		keys, weights, err := termSources(conn, term)
+		if err != nil {
+			return nil, err
+		}
+		termKeys[i] = searchTempKeyPrefix + strconv.Itoa(i)
+		tx.add("ZUNIONSTORE", redis.Args{}.Add(termKeys[i], len(keys)).AddFlat(keys).
+			Add("WEIGHTS").AddFlat(weights).Add("AGGREGATE", "MAX")...)
+	}
+	resultKey := searchTempKeyPrefix + "result"
+	tx.add("ZINTERSTORE", redis.Args{}.Add(resultKey, len(termKeys)).AddFlat(termKeys).Add("AGGREGATE", "SUM")...)
+	tx.add("ZREVRANGE", resultKey, 0, limit-1)
+	tx.add("DEL", redis.Args{}.Add(resultKey).AddFlat(termKeys)...)
+	replies, err := tx.exec(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(replies) != len(tx) {
+		return nil, fmt.Errorf("search: %d replies to %d commands", len(replies), len(tx))
+	}
+	return redis.Ints(replies[len(tx)-2], nil)
+}
+
+// termSources returns the sorted sets of the users matching term and their
+// weights: the users with a word starting with term, and from minTypoLength on
+// the users with a word one typo away
+func termSources(conn redis.Conn, term string) ([]string, []float64, error) {
+	n := utf8.RuneCountInString(term)
+	if n < minPrefixLength {
+		//a term too short to be a prefix only finds the words equal to it
+		return []string{wordKeyPrefix + term}, []float64{1}, nil
+	}
+	keys, weights := []string{searchKeyPrefix + term}, []float64{1}
+	if n < minTypoLength {
+		return keys, weights, nil
+	}
+	words, err := typoWords(conn, term)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, word := range words {
+		keys = append(keys, wordKeyPrefix+word)
+		weights = append(weights, typoPenalty)
+	}
+	return keys, weights, nil
+}
+
+// typoWords returns the indexed words one edit away from term
+func typoWords(conn redis.Conn, term string) ([]string, error) {
+	variants := typoVariants(term)
+	for _, variant := range variants {
+		if err := conn.Send("SMEMBERS", typoKeyPrefix+variant); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	seen := make(map[string]bool)
+	for _, reply := range replies {
+		candidates, err := redis.Strings(reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, word := range candidates {
+			if !seen[word] && isTypo(term, word) {
+				seen[word] = true
+				words = append(words, word)
+			}
+		}
+	}
+	return words, nil
+}
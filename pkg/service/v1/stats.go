@@ -0,0 +1,231 @@
+package v1
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	// statsKey is a hash of the total of the users and the sum of their ages
+	statsKey = "users:stats"
+	// statsCitiesKey is a sorted set of the normalized cities, scored by their
+	// number of users
+	statsCitiesKey = "users:stats:cities"
+	// statsAgesKey is a sorted set of the age buckets, named by their lowest
+	// age and scored by their number of users
+	statsAgesKey = "users:stats:ages"
+	// statsIDsKey is the set of the users counted in the stats, so the users
+	// stored before the stats existed are counted once
+	statsIDsKey = "users:stats:ids"
+)
+
+// AgeBucketSize is the number of ages in each bucket of the age histogram
+const AgeBucketSize = 10
+
+// Stats sums up the users that are not deleted. The ages are 0 when there are
+// no users.
+type Stats struct {
+	Total int
+	// Cities has the number of users of each city, normalized to lowercase,
+	// users without a city are left out
+	Cities  map[string]int
+	MinAge  int
+	MaxAge  int
+	MeanAge float64
+	// AgeHistogram has the buckets with users, ordered by age
+	AgeHistogram []AgeBucket
+}
+
+// AgeBucket counts the users aged from Min to Max included
+type AgeBucket struct {
+	Min   int
+	Max   int
+	Count int
+}
+
+// ageBucket returns the lowest age of the bucket of age
+func ageBucket(age int) int {
+	if age < 0 {
+		return 0
+	}
+	return age / AgeBucketSize * AgeBucketSize
+}
+
+// updateStats queues the changes to the counters of the stats for a user going
+// from before to after, the user key being watched keeps them exact
+func updateStats(tx *transaction, userID int, before, after *User) {
+	var total, ageSum int
+	cities := make(map[string]int)
+	buckets := make(map[string]int)
+	if before != nil {
+		total--
+		ageSum -= before.Age
+		cities[normalizeCity(before.City)]--
+		buckets[strconv.Itoa(ageBucket(before.Age))]--
+	}
+	if after != nil {
+		total++
+		ageSum += after.Age
+		cities[normalizeCity(after.City)]++
+		buckets[strconv.Itoa(ageBucket(after.Age))]++
+	}
+	if total > 0 {
+		tx.add("SADD", statsIDsKey, userID)
+	} else if total < 0 {
+		tx.add("SREM", statsIDsKey, userID)
+	}
+	if total != 0 {
+		tx.add("HINCRBY", statsKey, "total", total)
+	}
+	if ageSum != 0 {
+		tx.add("HINCRBY", statsKey, "age_sum", ageSum)
+	}
+	updateCounts(tx, statsCitiesKey, cities)
+	updateCounts(tx, statsAgesKey, buckets)
+}
+
+// updateCounts queues the changes to the counts of the sorted set at key, the
+// members left without users are removed
+func updateCounts(tx *transaction, key string, counts map[string]int) {
+	members := make([]string, 0, len(counts))
+	for member := range counts {
+		members = append(members, member)
+	}
+	//sorted so the commands are the same on every run
+	sort.Strings(members)
+	decremented := false
+	for _, member := range members {
+		if member == "" || counts[member] == 0 {
+			continue
+		}
+		tx.add("ZINCRBY", key, counts[member], member)
+		decremented = decremented || counts[member] < 0
+	}
+	if decremented {
+		tx.add("ZREMRANGEBYSCORE", key, "-inf", 0)
+	}
+}
+
+// countUserScript counts a user stored before the stats existed, unless it is
+// counted already
+const countUserScript = `
+if redis.call("SADD", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call("HINCRBY", KEYS[2], "total", 1)
+redis.call("HINCRBY", KEYS[2], "age_sum", ARGV[2])
+if ARGV[3] ~= "" then
+	redis.call("ZINCRBY", KEYS[3], 1, ARGV[3])
+end
+redis.call("ZINCRBY", KEYS[4], 1, ARGV[4])
+return 1
+`
+
+// countUser queues countUserScript for a user, with EVAL as EVALSHA could
+// fail inside MULTI
+func countUser(tx *transaction, userID int, user *User) {
+	tx.add("EVAL", countUserScript, 4, statsIDsKey, statsKey, statsCitiesKey, statsAgesKey,
+		userID, user.Age, normalizeCity(user.City), ageBucket(user.Age))
+}
+
+// UserStats reads the stats from their counters, and the youngest and oldest
+// users from the age index
+func UserStats(conn redis.Conn) (*Stats, error) {
+	commands := []redis.Args{
+		{"HMGET", statsKey, "total", "age_sum"},
+		{"ZRANGE", statsCitiesKey, 0, -1, "WITHSCORES"},
+		{"ZRANGE", statsAgesKey, 0, -1, "WITHSCORES"},
+		{"ZRANGE", ageIndexKey, 0, 0, "WITHSCORES"},
+		{"ZREVRANGE", ageIndexKey, 0, 0, "WITHSCORES"},
+	}
+	for _, cmd := range commands {
+		if err := conn.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+	counters, err := redis.Strings(replies[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	stats := &Stats{Cities: make(map[string]int)}
+	if stats.Total, _ = strconv.Atoi(counters[0]); stats.Total <= 0 {
+		stats.Total = 0
+		return stats, nil
+	}
+	ageSum, _ := strconv.Atoi(counters[1])
+	stats.MeanAge = float64(ageSum) / float64(stats.Total)
+	cities, err := redis.IntMap(replies[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	for city, count := range cities {
+		if count > 0 {
+			stats.Cities[city] = count
+		}
+	}
+	buckets, err := redis.IntMap(replies[2], nil)
+	if err != nil {
+		return nil, err
+	}
+	for bucket, count := range buckets {
+		low, err := strconv.Atoi(bucket)
+		if err != nil || count <= 0 {
+			continue
+		}
+		stats.AgeHistogram = append(stats.AgeHistogram, AgeBucket{Min: low, Max: low + AgeBucketSize - 1, Count: count})
+	}
+	sortAgeHistogram(stats.AgeHistogram)
+	if stats.MinAge, err = firstScore(replies[3]); err != nil {
+		return nil, err
+	}
+	if stats.MaxAge, err = firstScore(replies[4]); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// firstScore returns the score of the only member of a ZRANGE WITHSCORES
+// reply, 0 when it is empty
+func firstScore(reply interface{}) (int, error) {
+	values, err := redis.Strings(reply, nil)
+	if err != nil || len(values) < 2 {
+		return 0, err
+	}
+	return strconv.Atoi(values[1])
+}
+
+func sortAgeHistogram(buckets []AgeBucket) {
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Min < buckets[j].Min })
+}
+
+// statsOf sums up users, as UserStats does from the counters
+func statsOf(users []*User) *Stats {
+	stats := &Stats{Total: len(users), Cities: make(map[string]int)}
+	if len(users) == 0 {
+		return stats
+	}
+	buckets := make(map[int]int)
+	ageSum := 0
+	stats.MinAge, stats.MaxAge = users[0].Age, users[0].Age
+	for _, user := range users {
+		if city := normalizeCity(user.City); city != "" {
+			stats.Cities[city]++
+		}
+		buckets[ageBucket(user.Age)]++
+		ageSum += user.Age
+		stats.MinAge = min(stats.MinAge, user.Age)
+		stats.MaxAge = max(stats.MaxAge, user.Age)
+	}
+	stats.MeanAge = float64(ageSum) / float64(len(users))
+	for bucket, count := range buckets {
+		stats.AgeHistogram = append(stats.AgeHistogram, AgeBucket{Min: bucket, Max: bucket + AgeBucketSize - 1, Count: count})
+	}
+	sortAgeHistogram(stats.AgeHistogram)
+	return stats
+}
@@ -0,0 +1,17 @@
+package v1
+
+import "context"
+
+// UserStore is the storage backend used by the REST handlers to read and write users
+type UserStore interface {
+	ListAllUsers(ctx context.Context) ([]*User, error)
+	ListUsers(ctx context.Context, opts ListOptions) (*UserPage, error)
+	CountUsers(ctx context.Context) (int, error)
+	UserStats(ctx context.Context) (*Stats, error)
+	FindUserByID(ctx context.Context, userID int) (*User, error)
+	FindUserByEmail(ctx context.Context, email string) (*User, error)
+	SearchUsers(ctx context.Context, query string, limit int) ([]*SearchResult, error)
+	CreateOrUpdateUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, userID int, fn func(user *User) error) (*User, error)
+	DeleteUser(ctx context.Context, userID int, opts DeleteOptions) error
+}
@@ -0,0 +1,765 @@
+package v1
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newRedisUserStore(t *testing.T) *RedisUserStore {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	t.Cleanup(func() { pool.Close() })
+	return NewRedisUserStore(pool)
+}
+
+func userStores(t *testing.T) map[string]UserStore {
+	return map[string]UserStore{
+		"redis":  newRedisUserStore(t),
+		"memory": NewMemoryUserStore(),
+	}
+}
+
+func TestUserStoreCreateAndFind(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Name: "Doe", Age: 33, City: "Vancouver"}
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if user.ID != 1 {
+				t.Errorf("user.ID = %d, expect 1", user.ID)
+			}
+			found, err := store.FindUserByID(ctx, user.ID)
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if !reflect.DeepEqual(found, user) {
+				t.Errorf("FindUserByID() = %+v, expect %+v", found, user)
+			}
+		})
+	}
+}
+
+func TestUserStoreUpdate(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Name: "Doe", Age: 33, City: "Vancouver"}
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			user.City = "Toronto"
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			found, err := store.FindUserByID(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.City != "Toronto" {
+				t.Errorf("FindUserByID().City = %s, expect Toronto", found.City)
+			}
+		})
+	}
+}
+
+func TestUserStoreNotFound(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if _, err := store.FindUserByID(ctx, 4); err != ErrNoUserFound {
+				t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+			}
+			err := store.CreateOrUpdateUser(ctx, &User{ID: 4, Name: "Doe"})
+			if err != ErrNoUserFound {
+				t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+			}
+		})
+	}
+}
+
+func TestUserStoreListAllUsers(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			users, err := store.ListAllUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if users != nil {
+				t.Errorf("ListAllUsers() = %v, expect null", users)
+			}
+			for _, name := range []string{"John", "Doe"} {
+				if err := store.CreateOrUpdateUser(ctx, &User{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			users, err = store.ListAllUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 2 || users[0].Name != "John" || users[1].Name != "Doe" {
+				t.Errorf("ListAllUsers() = %v, expect John and Doe", users)
+			}
+		})
+	}
+}
+
+func TestUserStoreListUsersPages(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for i := 0; i < 5; i++ {
+				if err := store.CreateOrUpdateUser(ctx, &User{Name: "John"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var ids []int
+			opts := ListOptions{Limit: 2}
+			for pages := 1; ; pages++ {
+				page, err := store.ListUsers(ctx, opts)
+				if err != nil {
+					t.Fatalf("error: got %s, expected no error", err.Error())
+				}
+				for _, user := range page.Users {
+					ids = append(ids, user.ID)
+				}
+				if page.NextCursor == "" {
+					if pages != 3 {
+						t.Errorf("got %d pages, expect 3", pages)
+					}
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+			if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+				t.Errorf("ListUsers() ids = %v, expect 1 to 5", ids)
+			}
+		})
+	}
+}
+
+func TestUserStoreListUsersInvalidCursor(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			_, err := store.ListUsers(context.Background(), ListOptions{Cursor: "not a cursor"})
+			if err != ErrInvalidCursor {
+				t.Errorf("error: got %v, expected %s", err, ErrInvalidCursor)
+			}
+			//the cursors of listings by ID and of sorted listings are not mixed up
+			sorted := []SortField{{Field: SortByAge}}
+			if _, err := store.ListUsers(context.Background(), ListOptions{Cursor: encodeCursor(2), Sort: sorted}); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("ID cursor of a sorted listing: error: got %v, expected %s", err, ErrInvalidCursor)
+			}
+			if _, err := store.ListUsers(context.Background(), ListOptions{Cursor: encodeOffsetCursor(2)}); !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("offset cursor of a listing by ID: error: got %v, expected %s", err, ErrInvalidCursor)
+			}
+		})
+	}
+}
+
+func TestUserStoreDeleteUser(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, name := range []string{"John", "Doe"} {
+				if err := store.CreateOrUpdateUser(ctx, &User{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.DeleteUser(ctx, 1, DeleteOptions{Soft: true}); err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if _, err := store.FindUserByID(ctx, 1); err != ErrNoUserFound {
+				t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+			}
+			page, err := store.ListUsers(ctx, ListOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Users) != 1 || page.Users[0].ID != 2 {
+				t.Errorf("ListUsers() = %v, expect only user 2", page.Users)
+			}
+			if err := store.DeleteUser(ctx, 1, DeleteOptions{}); err != nil {
+				t.Errorf("purge error: got %s, expected no error", err.Error())
+			}
+			if err := store.DeleteUser(ctx, 1, DeleteOptions{}); err != ErrNoUserFound {
+				t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+			}
+		})
+	}
+}
+
+func TestUserStoreUpdateUser(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			if err := store.CreateOrUpdateUser(ctx, &User{Name: "Doe", Age: 33, City: "Vancouver"}); err != nil {
+				t.Fatal(err)
+			}
+			user, err := store.UpdateUser(ctx, 1, func(user *User) error {
+				user.City = "Toronto"
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			found, err := store.FindUserByID(ctx, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.UpdatedAt < user.CreatedAt || user.CreatedAt == 0 {
+				t.Errorf("UpdateUser() timestamps = %d, %d, expect them set", user.CreatedAt, user.UpdatedAt)
+			}
+			expectUser := User{ID: 1, Name: "Doe", Age: 33, City: "Toronto", Version: 2, CreatedAt: user.CreatedAt, UpdatedAt: user.UpdatedAt}
+			if !reflect.DeepEqual(*user, expectUser) || !reflect.DeepEqual(*found, expectUser) {
+				t.Errorf("UpdateUser() = %+v, stored %+v, expect %+v", *user, *found, expectUser)
+			}
+			if _, err := store.UpdateUser(ctx, 4, func(user *User) error { return nil }); err != ErrNoUserFound {
+				t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+			}
+		})
+	}
+}
+
+func TestUserStoreVersions(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Name: "Doe", Age: 33, City: "Vancouver"}
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			if user.Version != 1 {
+				t.Errorf("created user.Version = %d, expect 1", user.Version)
+			}
+			unchanged, err := store.UpdateUser(ctx, user.ID, func(user *User) error { return nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unchanged.Version != 1 {
+				t.Errorf("version after a no-op update = %d, expect 1", unchanged.Version)
+			}
+			user.Age = 34
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if user.Version != 2 {
+				t.Errorf("updated user.Version = %d, expect 2", user.Version)
+			}
+			stale := &User{ID: user.ID, Name: "Doe", Version: 1}
+			if err := store.CreateOrUpdateUser(ctx, stale); err != ErrVersionMismatch {
+				t.Errorf("error: got %v, expected %s", err, ErrVersionMismatch)
+			}
+			if err := store.DeleteUser(ctx, user.ID, DeleteOptions{IfVersions: []int{1}}); err != ErrVersionMismatch {
+				t.Errorf("error: got %v, expected %s", err, ErrVersionMismatch)
+			}
+			if err := store.DeleteUser(ctx, user.ID, DeleteOptions{IfVersions: []int{1, 2}}); err != nil {
+				t.Errorf("error: got %s, expected no error", err.Error())
+			}
+		})
+	}
+}
+
+func TestUserStoreCountUsers(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, name := range []string{"John", "Doe", "Jane"} {
+				if err := store.CreateOrUpdateUser(ctx, &User{Name: name}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.DeleteUser(ctx, 1, DeleteOptions{Soft: true}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteUser(ctx, 2, DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			count, err := store.CountUsers(ctx)
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if count != 1 {
+				t.Errorf("CountUsers() = %d, expect 1", count)
+			}
+		})
+	}
+}
+
+func TestRedisUserStoreObserveCommands(t *testing.T) {
+	store := newRedisUserStore(t)
+	commands := make(map[string]int)
+	store.ObserveCommands(func(command string, latency time.Duration, err error) {
+		if err != nil {
+			t.Errorf("%s error: got %s, expected no error", command, err.Error())
+		}
+		commands[command]++
+	})
+	ctx := context.Background()
+	if err := store.CreateOrUpdateUser(ctx, &User{Name: "Doe"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.ListUsers(ctx, ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"INCR", "WATCH", "EXEC", "ZRANGEBYSCORE", "PIPELINE"} {
+		if commands[command] == 0 {
+			t.Errorf("command %s not observed, got %v", command, commands)
+		}
+	}
+}
+
+func TestUserStoreAttributes(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Name: "Doe", Email: "doe@example.com", Phone: "+1 604 555 0100", Attributes: map[string]string{"team": "core"}}
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			user.Attributes["team"] = "changed by the caller"
+			found, err := store.FindUserByID(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found.Email != "doe@example.com" || found.Phone != "+1 604 555 0100" || found.Attributes["team"] != "core" {
+				t.Errorf("FindUserByID() = %+v, expect the email, phone and attributes stored", found)
+			}
+
+			updated, err := store.UpdateUser(ctx, user.ID, func(user *User) error {
+				user.Attributes["plan"] = "pro"
+				delete(user.Attributes, "team")
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if updated.Version != 2 {
+				t.Errorf("version after an attribute change = %d, expect 2", updated.Version)
+			}
+			found, err = store.FindUserByID(ctx, user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(found.Attributes, map[string]string{"plan": "pro"}) {
+				t.Errorf("FindUserByID().Attributes = %v, expect only plan", found.Attributes)
+			}
+
+			updated, err = store.UpdateUser(ctx, user.ID, func(user *User) error {
+				user.Attributes = nil
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Attributes != nil || updated.Version != 3 {
+				t.Errorf("UpdateUser() = %+v, expect the attributes removed in version 3", updated)
+			}
+		})
+	}
+}
+
+func TestUserStoreTimestamps(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			user := &User{Name: "Doe", CreatedAt: 1, UpdatedAt: 1}
+			if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+			created := user.CreatedAt
+			if created <= 1 || user.UpdatedAt != created {
+				t.Errorf("created user timestamps = %d, %d, expect both set to the creation time", user.CreatedAt, user.UpdatedAt)
+			}
+			time.Sleep(2 * time.Millisecond)
+			unchanged, err := store.UpdateUser(ctx, user.ID, func(user *User) error {
+				user.CreatedAt = 1
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if unchanged.CreatedAt != created || unchanged.UpdatedAt != created {
+				t.Errorf("no-op update timestamps = %d, %d, expect %d", unchanged.CreatedAt, unchanged.UpdatedAt, created)
+			}
+			updated, err := store.UpdateUser(ctx, user.ID, func(user *User) error {
+				user.Age = 40
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.CreatedAt != created || updated.UpdatedAt <= created {
+				t.Errorf("updated user timestamps = %d, %d, expect only UpdatedAt to move", updated.CreatedAt, updated.UpdatedAt)
+			}
+		})
+	}
+}
+
+func TestUserStoreEmailIndex(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			john := &User{Name: "John", Email: "John@Example.com"}
+			if err := store.CreateOrUpdateUser(ctx, john); err != nil {
+				t.Fatal(err)
+			}
+			found, err := store.FindUserByEmail(ctx, "john@example.com")
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if found.ID != john.ID {
+				t.Errorf("FindUserByEmail() = %+v, expect John", found)
+			}
+			if err := store.CreateOrUpdateUser(ctx, &User{Name: "Impostor", Email: "JOHN@example.com"}); err != ErrEmailTaken {
+				t.Errorf("duplicate create error: got %v, expected %s", err, ErrEmailTaken)
+			}
+
+			doe := &User{Name: "Doe", Email: "doe@example.com"}
+			if err := store.CreateOrUpdateUser(ctx, doe); err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UpdateUser(ctx, doe.ID, func(user *User) error {
+				user.Email = "john@example.com"
+				return nil
+			})
+			if err != ErrEmailTaken {
+				t.Errorf("duplicate update error: got %v, expected %s", err, ErrEmailTaken)
+			}
+
+			//a changed email frees the old one
+			if _, err := store.UpdateUser(ctx, john.ID, func(user *User) error {
+				user.Email = "johnny@example.com"
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.FindUserByEmail(ctx, "john@example.com"); err != ErrNoUserFound {
+				t.Errorf("old email error: got %v, expected %s", err, ErrNoUserFound)
+			}
+			if _, err := store.UpdateUser(ctx, doe.ID, func(user *User) error {
+				user.Email = "john@example.com"
+				return nil
+			}); err != nil {
+				t.Errorf("error: got %s, expected the freed email to be taken", err.Error())
+			}
+
+			//deleted users free their email
+			if err := store.DeleteUser(ctx, doe.ID, DeleteOptions{Soft: true}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.FindUserByEmail(ctx, "john@example.com"); err != ErrNoUserFound {
+				t.Errorf("soft-deleted email error: got %v, expected %s", err, ErrNoUserFound)
+			}
+			jane := &User{Name: "Jane", Email: "john@example.com"}
+			if err := store.CreateOrUpdateUser(ctx, jane); err != nil {
+				t.Errorf("error: got %s, expected the email of a deleted user to be free", err.Error())
+			}
+			if err := store.DeleteUser(ctx, doe.ID, DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			found, err = store.FindUserByEmail(ctx, "john@example.com")
+			if err != nil || found.ID != jane.ID {
+				t.Errorf("FindUserByEmail() = %+v, %v, expect Jane after Doe was purged", found, err)
+			}
+		})
+	}
+}
+
+func TestUserStoreListUsersFiltered(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, user := range []*User{
+				{Name: "John", Age: 31, City: "New York"},
+				{Name: "Doe", Age: 22, City: "Vancouver"},
+				{Name: "jane", Age: 28, City: "vancouver"},
+				{Name: "Joe", Age: 45, City: "Toronto"},
+				{Name: "Jim", Age: 28, City: "Vancouver"},
+			} {
+				if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			minAge, maxAge := 25, 40
+			sortByAgeThenName, _ := ParseSort("-age,name")
+			sortByCityThenName, _ := ParseSort("-city,name")
+			sortByCityThenAge, _ := ParseSort("city,-age")
+			tests := []struct {
+				name     string
+				opts     ListOptions
+				expected []int
+			}{
+				{"city", ListOptions{Filter: Filter{City: "VANCOUVER"}}, []int{2, 3, 5}},
+				{"age range", ListOptions{Filter: Filter{MinAge: &minAge, MaxAge: &maxAge}}, []int{1, 3, 5}},
+				{"name prefix", ListOptions{Filter: Filter{NamePrefix: "J"}}, []int{1, 3, 4, 5}},
+				{"every filter", ListOptions{Filter: Filter{City: "vancouver", MinAge: &minAge, NamePrefix: "ja"}}, []int{3}},
+				{"no match", ListOptions{Filter: Filter{City: "Paris"}}, nil},
+				{"sort", ListOptions{Sort: sortByAgeThenName}, []int{4, 1, 3, 5, 2}},
+				{"filter and sort", ListOptions{Filter: Filter{City: "Vancouver"}, Sort: []SortField{{Field: SortByName}}}, []int{2, 3, 5}},
+				{"sort by age", ListOptions{Sort: []SortField{{Field: SortByAge}}}, []int{2, 3, 5, 1, 4}},
+				{"sort by age descending", ListOptions{Sort: []SortField{{Field: SortByAge, Desc: true}}}, []int{4, 1, 5, 3, 2}},
+				{"sort by age in range", ListOptions{Filter: Filter{MinAge: &minAge, MaxAge: &maxAge}, Sort: []SortField{{Field: SortByAge, Desc: true}}}, []int{1, 5, 3}},
+				{"sort by name with prefix", ListOptions{Filter: Filter{NamePrefix: "j"}, Sort: []SortField{{Field: SortByName, Desc: true}}}, []int{1, 4, 5, 3}},
+				{"sort by id descending", ListOptions{Filter: Filter{City: "vancouver"}, Sort: []SortField{{Field: SortByID, Desc: true}}}, []int{5, 3, 2}},
+				{"sort by city", ListOptions{Sort: []SortField{{Field: SortByCity}}}, []int{1, 4, 2, 3, 5}},
+				{"sort by city descending then name", ListOptions{Sort: sortByCityThenName}, []int{2, 3, 5, 4, 1}},
+				{"sort by city in city", ListOptions{Filter: Filter{City: "VANCOUVER"}, Sort: sortByCityThenName}, []int{2, 3, 5}},
+			}
+			for _, test := range tests {
+				page, err := store.ListUsers(ctx, test.opts)
+				if err != nil {
+					t.Fatalf("%s: error: got %s, expected no error", test.name, err.Error())
+				}
+				var ids []int
+				for _, user := range page.Users {
+					ids = append(ids, user.ID)
+				}
+				if !reflect.DeepEqual(ids, test.expected) || page.NextCursor != "" {
+					t.Errorf("%s: ListUsers() ids = %v, cursor %q, expect %v on a single page", test.name, ids, page.NextCursor, test.expected)
+				}
+			}
+
+			for _, test := range []struct {
+				opts     ListOptions
+				expected []int
+			}{
+				{ListOptions{Limit: 2, Sort: sortByAgeThenName}, []int{4, 1, 3, 5, 2}},
+				{ListOptions{Limit: 3, Sort: sortByAgeThenName}, []int{4, 1, 3, 5, 2}},
+				{ListOptions{Limit: 2, Sort: sortByCityThenAge}, []int{1, 4, 5, 3, 2}},
+				{ListOptions{Limit: 1, Sort: []SortField{{Field: SortByCity, Desc: true}}}, []int{5, 3, 2, 4, 1}},
+				{ListOptions{Limit: 2, Sort: []SortField{{Field: SortByAge}}}, []int{2, 3, 5, 1, 4}},
+				{ListOptions{Limit: 1, Filter: Filter{City: "vancouver"}, Sort: []SortField{{Field: SortByName}}}, []int{2, 3, 5}},
+			} {
+				var ids []int
+				opts := test.opts
+				for {
+					page, err := store.ListUsers(ctx, opts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, user := range page.Users {
+						ids = append(ids, user.ID)
+					}
+					if page.NextCursor == "" {
+						break
+					}
+					opts.Cursor = page.NextCursor
+				}
+				if !reflect.DeepEqual(ids, test.expected) {
+					t.Errorf("sorted pages of %+v: ids = %v, expect %v", test.opts, ids, test.expected)
+				}
+			}
+
+			if _, err := store.UpdateUser(ctx, 3, func(user *User) error {
+				user.City = "Toronto"
+				user.Age = 50
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteUser(ctx, 5, DeleteOptions{Soft: true}); err != nil {
+				t.Fatal(err)
+			}
+			page, err := store.ListUsers(ctx, ListOptions{Filter: Filter{City: "Vancouver"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Users) != 1 || page.Users[0].ID != 2 {
+				t.Errorf("after update and delete: ListUsers() = %+v, expect only user 2", page.Users)
+			}
+		})
+	}
+}
+
+func TestRedisUserStoreSortWithFilterRoundTrips(t *testing.T) {
+	store := newRedisUserStore(t)
+	ctx := context.Background()
+	for i := 0; i < 100; i++ {
+		user := &User{Name: "John", Age: i, City: "Toronto"}
+		if i == 90 {
+			user.City = "Rome"
+		}
+		if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commands := 0
+	store.ObserveCommands(func(command string, latency time.Duration, err error) {
+		commands++
+	})
+	page, err := store.ListUsers(ctx, ListOptions{Limit: 5, Filter: Filter{City: "rome"}, Sort: []SortField{{Field: SortByAge}}})
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if len(page.Users) != 1 || page.Users[0].Age != 90 {
+		t.Errorf("ListUsers() = %+v, expect the user of Rome", page.Users)
+	}
+	//the candidates of the city are sorted rather than the age index walked
+	if commands > 4 {
+		t.Errorf("ListUsers() sent %d commands, expect at most 4", commands)
+	}
+}
+
+func TestParseSort(t *testing.T) {
+	fields, err := ParseSort("age,-name")
+	expected := []SortField{{Field: SortByAge}, {Field: SortByName, Desc: true}}
+	if err != nil || !reflect.DeepEqual(fields, expected) {
+		t.Errorf("ParseSort() = %v, %v, expect %v", fields, err, expected)
+	}
+	for _, s := range []string{"email", "age,", "-", "age;name"} {
+		if _, err := ParseSort(s); !errors.Is(err, ErrInvalidSort) {
+			t.Errorf("ParseSort(%q) error = %v, expect %s", s, err, ErrInvalidSort)
+		}
+	}
+}
+
+func TestUserStoreSearchUsers(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, user := range []*User{
+				{Name: "John Smith", Age: 31, City: "New York"},
+				{Name: "Johnny", Age: 22, City: "Vancouver"},
+				{Name: "Jane", Age: 28, City: "Johnstown"},
+				{Name: "<b>Joe</b>", Age: 45, City: "Vancouver"},
+			} {
+				if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			type match struct {
+				ID         int
+				Highlights map[string]string
+			}
+			tests := []struct {
+				query    string
+				expected []match
+			}{
+				{"john", []match{
+					{1, map[string]string{"name": "<em>John</em> Smith"}},
+					{2, map[string]string{"name": "<em>John</em>ny"}},
+					{3, map[string]string{"city": "<em>John</em>stown"}},
+				}},
+				{"JHON", []match{{1, map[string]string{"name": "<em>John</em> Smith"}}}},
+				{"john vancouver", []match{{2, map[string]string{"name": "<em>John</em>ny", "city": "<em>Vancouver</em>"}}}},
+				{"joe", []match{{4, map[string]string{"name": "&lt;b&gt;<em>Joe</em>&lt;/b&gt;"}}}},
+				{"j", nil},
+				{"paris", nil},
+				{"", nil},
+			}
+			for _, test := range tests {
+				results, err := store.SearchUsers(ctx, test.query, 0)
+				if err != nil {
+					t.Fatalf("%q: error: got %s, expected no error", test.query, err.Error())
+				}
+				var matches []match
+				for _, result := range results {
+					matches = append(matches, match{result.User.ID, result.Highlights})
+				}
+				if !reflect.DeepEqual(matches, test.expected) {
+					t.Errorf("SearchUsers(%q) = %+v, expect %+v", test.query, matches, test.expected)
+				}
+			}
+
+			if results, _ := store.SearchUsers(ctx, "john", 1); len(results) != 1 || results[0].User.ID != 1 {
+				t.Errorf("SearchUsers() with limit 1 = %+v, expect user 1", results)
+			}
+
+			if _, err := store.UpdateUser(ctx, 2, func(user *User) error {
+				user.Name = "Bob"
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteUser(ctx, 1, DeleteOptions{}); err != nil {
+				t.Fatal(err)
+			}
+			results, err := store.SearchUsers(ctx, "john", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || results[0].User.ID != 3 {
+				t.Errorf("after update and delete: SearchUsers() = %+v, expect only user 3", results)
+			}
+		})
+	}
+}
+
+func TestUserStoreStats(t *testing.T) {
+	for name, store := range userStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			stats, err := store.UserStats(ctx)
+			if err != nil {
+				t.Fatalf("error: got %s, expected no error", err.Error())
+			}
+			if !reflect.DeepEqual(stats, &Stats{Cities: map[string]int{}}) {
+				t.Errorf("no users: UserStats() = %+v, expect zero stats", stats)
+			}
+			for _, user := range []*User{
+				{Name: "John", Age: 31, City: "New York"},
+				{Name: "Doe", Age: 22, City: "Vancouver"},
+				{Name: "Jane", Age: 28, City: "vancouver"},
+				{Name: "Joe", Age: 45},
+			} {
+				if err := store.CreateOrUpdateUser(ctx, user); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected := &Stats{
+				Total:   4,
+				Cities:  map[string]int{"new york": 1, "vancouver": 2},
+				MinAge:  22,
+				MaxAge:  45,
+				MeanAge: 31.5,
+				AgeHistogram: []AgeBucket{
+					{Min: 20, Max: 29, Count: 2},
+					{Min: 30, Max: 39, Count: 1},
+					{Min: 40, Max: 49, Count: 1},
+				},
+			}
+			if stats, err = store.UserStats(ctx); err != nil || !reflect.DeepEqual(stats, expected) {
+				t.Errorf("UserStats() = %+v, %v, expect %+v", stats, err, expected)
+			}
+
+			if _, err := store.UpdateUser(ctx, 1, func(user *User) error {
+				user.City = "Vancouver"
+				user.Age = 24
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.DeleteUser(ctx, 4, DeleteOptions{Soft: true}); err != nil {
+				t.Fatal(err)
+			}
+			expected = &Stats{
+				Total:        3,
+				Cities:       map[string]int{"vancouver": 3},
+				MinAge:       22,
+				MaxAge:       28,
+				MeanAge:      (24 + 22 + 28) / 3.0,
+				AgeHistogram: []AgeBucket{{Min: 20, Max: 29, Count: 3}},
+			}
+			if stats, err = store.UserStats(ctx); err != nil || !reflect.DeepEqual(stats, expected) {
+				t.Errorf("after update and delete: UserStats() = %+v, %v, expect %+v", stats, err, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package v1
+
+import (
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxTxRetries bounds how often a transaction is retried when its watched key
+// keeps being modified by other clients
+const maxTxRetries = 10
+
+var ErrTooManyConflicts = errors.New("too many concurrent writes, try again")
+
+// transaction holds the commands queued between MULTI and EXEC
+type transaction []redis.Args
+
+func (tx *transaction) add(cmd string, args ...interface{}) {
+	*tx = append(*tx, redis.Args{cmd}.Add(args...))
+}
+
+// exec runs the commands of tx atomically with MULTI/EXEC and returns their
+// replies, which are missing when a watched key aborted the transaction
+func (tx transaction) exec(conn redis.Conn) ([]interface{}, error) {
+	if err := conn.Send("MULTI"); err != nil {
+		return nil, err
+	}
+	for _, cmd := range tx {
+		if err := conn.Send(cmd[0].(string), cmd[1:]...); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil && err != redis.ErrNil {
+		return nil, err
+	}
+	return replies, nil
+}
+
+// watch runs fn with key under WATCH, fn reads what it needs through conn and
+// returns the writes to apply, which are executed atomically with MULTI/EXEC.
+// When key changes before EXEC the whole read-modify-write is retried, so fn may
+// run more than once.
+func watch(conn redis.Conn, key string, fn func() (transaction, error)) error {
+	for i := 0; i < maxTxRetries; i++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			return err
+		}
+		tx, err := fn()
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		replies, err := tx.exec(conn)
+		if err != nil {
+			return err
+		}
+		//an aborted EXEC replies nil (or an empty list with miniredis), the key was
+		//modified by someone else so start over
+		if len(replies) != len(tx) {
+			continue
+		}
+		for _, reply := range replies {
+			if err, ok := reply.(redis.Error); ok {
+				return err
+			}
+		}
+		return nil
+	}
+	return ErrTooManyConflicts
+}
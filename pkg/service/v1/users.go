@@ -1,125 +1,625 @@
 package v1
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gomodule/redigo/redis"
 )
 
 type User struct {
-	ID   int    `redis:"id"`
-	Name string `redis:"name"`
-	Age  int    `redis:"age"`
-	City string `redis:"city"`
+	ID    int    `redis:"id"`
+	Name  string `redis:"name"`
+	Age   int    `redis:"age"`
+	City  string `redis:"city"`
+	Email string `redis:"email"`
+	Phone string `redis:"phone"`
+	//Version is incremented on every change of the user, hashes written before
+	//versioning existed are read as version 1
+	Version int `redis:"version"`
+	//CreatedAt and UpdatedAt are unix times in milliseconds set by the store,
+	//they are 0 for hashes written before they existed
+	CreatedAt int64 `redis:"created_at"`
+	UpdatedAt int64 `redis:"updated_at"`
+	//Attributes are free-form, kept in their own hash next to the user hash
+	Attributes map[string]string `redis:"-"`
 }
 
-var userKeyPrefix = "user:"
+var (
+	userKeyPrefix = "user:"
+	//attributesKeySuffix is appended to the user key for the hash of its attributes
+	attributesKeySuffix = ":attrs"
+	//userIndexKey is a sorted set of every user ID, scored by the ID itself
+	userIndexKey = "users:ids"
+	//deletedAtField marks a soft-deleted user hash with the unix time of deletion
+	deletedAtField = "deleted_at"
+	//userIncrIDKey holds the last ID given to a user
+	userIncrIDKey = "userIncrID"
+	//seededKey is set once the seed users are stored, with the time they were
+	seededKey = "users:seeded"
+	//indexedKey is set once the users stored before the indexes existed are
+	//indexed, with the time they were
+	indexedKey = "users:indexed"
+)
 
 var (
-	ErrNoUserFound = errors.New("no user found")
+	ErrNoUserFound     = errors.New("no user found")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+	ErrVersionMismatch = errors.New("user version does not match")
+)
+
+const (
+	DefaultPageLimit = 20
+	MaxPageLimit     = 100
 )
 
+//ListOptions selects one page of users, Cursor is the NextCursor of the previous page
+type ListOptions struct {
+	Cursor string
+	Limit  int
+	//Filter narrows the users listed and Sort orders them, by ID when it is empty
+	Filter Filter
+	Sort   []SortField
+}
+
+//UserPage is one page of users ordered by ID or by the fields they are sorted by,
+//NextCursor is empty on the last page
+type UserPage struct {
+	Users      []*User
+	NextCursor string
+}
+
+//DeleteOptions controls DeleteUser, a soft delete keeps the hash but hides the
+//user until it is purged by a hard delete
+type DeleteOptions struct {
+	Soft bool
+	//IfVersions, when set, only deletes the user if it is still at one of these
+	//versions
+	IfVersions []int
+}
+
+//matchVersion reports whether a user at version may be deleted
+func (opts DeleteOptions) matchVersion(version int) bool {
+	if len(opts.IfVersions) == 0 {
+		return true
+	}
+	for _, v := range opts.IfVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
 func ListAllUsers(conn redis.Conn) ([]*User, error) {
-	//Fetch all the keys match this pattern "user:[0-9]"
-	userIDPattern := userKeyPrefix + "[0-9]"
-	keys, err := redis.Strings(conn.Do("KEYS", userIDPattern))
+	//Fetch every user ID from the index, ordered by ID
+	ids, err := redis.Ints(conn.Do("ZRANGE", userIndexKey, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	return findUsersByIDs(conn, ids)
+}
+
+func ListUsers(conn redis.Conn, opts ListOptions) (*UserPage, error) {
+	if !opts.Filter.IsZero() || len(opts.Sort) > 0 {
+		return listFilteredUsers(conn, opts)
+	}
+	afterID, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return nil, err
+	}
+	limit := pageLimit(opts.Limit)
+	//fetch one extra ID to know whether another page follows
+	ids, err := redis.Ints(conn.Do("ZRANGEBYSCORE", userIndexKey, "("+strconv.Itoa(afterID), "+inf", "LIMIT", 0, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	page := &UserPage{}
+	if len(ids) > limit {
+		ids = ids[:limit]
+		page.NextCursor = encodeCursor(ids[limit-1])
+	}
+	page.Users, err = findUsersByIDs(conn, ids)
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+//CountUsers returns the number of users that are not deleted
+func CountUsers(conn redis.Conn) (int, error) {
+	return redis.Int(conn.Do("ZCARD", userIndexKey))
+}
+
+func pageLimit(limit int) int {
+	if limit <= 0 {
+		return DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		return MaxPageLimit
+	}
+	return limit
+}
+
+//encodeCursor makes the last ID of a page an opaque cursor for the next one
+func encodeCursor(lastID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(lastID)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	if strings.HasPrefix(string(raw), offsetCursorPrefix) {
+		return 0, fmt.Errorf("%w: the cursor of a sorted listing", ErrInvalidCursor)
+	}
+	lastID, err := strconv.Atoi(string(raw))
+	if err != nil || lastID < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return lastID, nil
+}
+
+//offsetCursorPrefix tells the cursors of sorted listings, which hold the number
+//of users already listed, from those of listings by ID
+const offsetCursorPrefix = "offset:"
+
+//encodeOffsetCursor makes the number of users listed so far an opaque cursor for
+//the next page of a sorted listing
+func encodeOffsetCursor(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(offsetCursorPrefix + strconv.Itoa(offset)))
+}
+
+//decodeOffsetCursor reads a cursor of encodeOffsetCursor, the cursor of a listing
+//by ID is rejected as the two cannot be mixed up
+func decodeOffsetCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	offset, ok := strings.CutPrefix(string(raw), offsetCursorPrefix)
+	if !ok {
+		return 0, fmt.Errorf("%w: not the cursor of a sorted listing", ErrInvalidCursor)
+	}
+	n, err := strconv.Atoi(offset)
+	if err != nil || n < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return n, nil
+}
+
+//findUsersByIDs fetches the given users in a single pipelined round trip, IDs
+//left in the index without a matching hash are skipped
+func findUsersByIDs(conn redis.Conn, ids []int) ([]*User, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	for _, id := range ids {
+		userKey := userKeyPrefix + strconv.Itoa(id)
+		if err := conn.Send("HGETALL", userKey); err != nil {
+			return nil, err
+		}
+		if err := conn.Send("HGETALL", userKey+attributesKeySuffix); err != nil {
+			return nil, err
+		}
+	}
+	replies, err := redis.Values(conn.Do(""))
 	if err != nil {
 		return nil, err
 	}
-	//Loop through found user keys and fetch each user record
 	var users []*User
-	for _, key := range keys {
-		idString := strings.TrimPrefix(key, userKeyPrefix)
-		id, err := strconv.Atoi(idString)
+	for i := 0; i < len(replies); i += 2 {
+		values, err := redis.Values(replies[i], nil)
 		if err != nil {
 			return nil, err
 		}
-		user, err := FindUserByID(conn, id)
+		if len(values) == 0 || isDeleted(values) {
+			continue
+		}
+		user, err := scanUser(values)
 		if err != nil {
 			return nil, err
 		}
+		if user.Attributes, err = scanAttributes(replies[i+1], nil); err != nil {
+			return nil, err
+		}
 		users = append(users, user)
 	}
-
 	return users, nil
 }
 
+//IndexExistingUsers adds user hashes written before the indexes existed to
+//them. It is a one-time migration: it walks the keyspace with SCAN, so Redis is
+//never blocked, and sets indexedKey once every user is indexed, so later calls
+//return right away.
+func IndexExistingUsers(conn redis.Conn) error {
+	done, err := redis.Bool(conn.Do("EXISTS", indexedKey))
+	if err != nil || done {
+		return err
+	}
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", userKeyPrefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			id, err := strconv.Atoi(strings.TrimPrefix(key, userKeyPrefix))
+			if err != nil || id <= 0 {
+				continue
+			}
+			if err := indexUserID(conn, id); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			_, err := conn.Do("SET", indexedKey, time.Now().Unix())
+			return err
+		}
+	}
+}
+
+//indexUserID adds a user to the ID index and to the indexes it is filtered and
+//searched by, and counts it in the stats. Its email is indexed unless another
+//user already has it. A soft-deleted user or a key that is not a hash is left
+//out. The user is read and indexed under WATCH, so a concurrent change is never
+//overwritten by the values read before it.
+func indexUserID(conn redis.Conn, id int) error {
+	userKey := userKeyPrefix + strconv.Itoa(id)
+	return watch(conn, userKey, func() (transaction, error) {
+		//the key may be gone since SCAN returned it
+		keyType, err := redis.String(conn.Do("TYPE", userKey))
+		if err != nil || keyType != "hash" {
+			return nil, err
+		}
+		fields, err := redis.Strings(conn.Do("HMGET", userKey, deletedAtField, "email", "name", "age", "city"))
+		if err != nil || fields[0] != "" {
+			return nil, err
+		}
+		age, _ := strconv.Atoi(fields[3])
+		user := &User{Name: fields[2], Age: age, City: fields[4]}
+		//every write is idempotent, so users indexed since are left as they are
+		var tx transaction
+		tx.add("ZADD", userIndexKey, id, id)
+		if email := normalizeEmail(fields[1]); email != "" {
+			tx.add("SETNX", emailKeyPrefix+email, id)
+		}
+		updateFilterIndexes(&tx, id, nil, user)
+		updateSearchIndex(&tx, id, nil, user)
+		countUser(&tx, id, user)
+		return tx, nil
+	})
+}
+
 func FindUserByID(conn redis.Conn, userID int) (*User, error) {
-	userKey := userKeyPrefix + strconv.Itoa(userID)
-	//get all the values stores for this userKey
-	values, err := redis.Values(conn.Do("HGETALL", userKey))
+	//the user hash and its attributes are fetched in a single round trip
+	users, err := findUsersByIDs(conn, []int{userID})
 	if err != nil {
 		return nil, err
 	}
-	if len(values) == 0 {
+	if len(users) == 0 {
 		return nil, ErrNoUserFound
 	}
+	return users[0], nil
+}
+
+//scanAttributes maps the HGETALL reply of an attributes hash, a user without
+//attributes gets a nil map
+func scanAttributes(reply interface{}, err error) (map[string]string, error) {
+	attributes, err := redis.StringMap(reply, err)
+	if err != nil || len(attributes) == 0 {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+//scanUser maps the HGETALL values of a user hash to a User
+func scanUser(values []interface{}) (*User, error) {
 	var user User
-	//map stored values to redis user struct
-	err = redis.ScanStruct(values, &user)
-	if err != nil {
+	if err := redis.ScanStruct(values, &user); err != nil {
 		return nil, err
 	}
+	if user.Version == 0 {
+		user.Version = 1
+	}
 	return &user, nil
 }
 
+//CreateOrUpdateUser creates the user when user.ID is not set and replaces it
+//otherwise, an update with user.Version set fails with ErrVersionMismatch unless
+//the stored user is still at that version. user.ID and user.Version are set to
+//the stored values on success.
 func CreateOrUpdateUser(conn redis.Conn, user *User) error {
-	var (
-		id     int
-		err    error
-		userID string
-		exists int
-	)
-
 	//check input user.ID to either create or update
 	if user.ID > 0 {
-		userID = "user:" + strconv.Itoa(user.ID)
-		exists, err = redis.Int(conn.Do("EXISTS", userID))
-		if exists == 0 {
-			return ErrNoUserFound
+		updated, err := UpdateUser(conn, user.ID, func(current *User) error {
+			if user.Version > 0 && user.Version != current.Version {
+				return ErrVersionMismatch
+			}
+			*current = *user
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-	} else {
-		id, err = getNewUserID(conn)
+		user.Version = updated.Version
+		return nil
+	}
+	return createUser(conn, user)
+}
+
+//createUser stores user under a newly allocated ID, the hash and its index entry
+//are only written if no hash exists under that ID yet
+func createUser(conn redis.Conn, user *User) error {
+	now := timestamp(time.Now())
+	for {
+		id, err := getNewUserID(conn)
 		if err != nil {
 			return err
 		}
-		user.ID = id
-		userID = "user:" + strconv.Itoa(id)
+		created, err := createUserAt(conn, id, user, now)
+		if err != nil {
+			return err
+		}
+		//IDs taken by hashes written outside of createUser are skipped
+		if created {
+			return nil
+		}
 	}
+}
 
-	if _, err = conn.Do("HMSET", redis.Args{}.Add(userID).AddFlat(user)...); err != nil {
+//SeedUsers stores users under their IDs the first time it is called on a
+//database, users stored there already are left as they are. A seeded user that
+//is deleted later does not come back, and userIncrID is raised past the seeded
+//IDs so new users never reuse them. It tells whether the users were seeded.
+func SeedUsers(conn redis.Conn, users []User) (bool, error) {
+	now := timestamp(time.Now())
+	seeded := false
+	err := watch(conn, seededKey, func() (transaction, error) {
+		done, err := redis.Bool(conn.Do("EXISTS", seededKey))
+		seeded = !done
+		if err != nil || done {
+			return nil, err
+		}
+		if _, err := conn.Do("WATCH", userIncrIDKey); err != nil {
+			return nil, err
+		}
+		lastID, err := redis.Int(conn.Do("GET", userIncrIDKey))
+		if err != nil && err != redis.ErrNil {
+			return nil, err
+		}
+		var tx transaction
+		for _, user := range users {
+			userKey := userKeyPrefix + strconv.Itoa(user.ID)
+			if _, err := conn.Do("WATCH", userKey); err != nil {
+				return nil, err
+			}
+			exists, err := redis.Bool(conn.Do("EXISTS", userKey))
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				newUser := user
+				newUser.Version = 1
+				newUser.CreatedAt = now
+				newUser.UpdatedAt = now
+				if err := addUser(conn, &tx, &newUser); err != nil {
+					return nil, err
+				}
+			}
+			if user.ID > lastID {
+				lastID = user.ID
+			}
+		}
+		tx.add("SET", userIncrIDKey, lastID)
+		tx.add("SETNX", seededKey, now)
+		return tx, nil
+	})
+	return seeded && err == nil, err
+}
+
+//createUserAt stores user under id with its indexes if no hash exists under it
+//yet, and sets the ID, version and timestamps of user when it does
+func createUserAt(conn redis.Conn, id int, user *User, now int64) (bool, error) {
+	userKey := userKeyPrefix + strconv.Itoa(id)
+	created := false
+	err := watch(conn, userKey, func() (transaction, error) {
+		exists, err := redis.Bool(conn.Do("EXISTS", userKey))
+		//set on every attempt, a retry may find the hash written meanwhile
+		created = !exists
+		if err != nil || exists {
+			return nil, err
+		}
+		newUser := *user
+		newUser.ID = id
+		newUser.Version = 1
+		newUser.CreatedAt = now
+		newUser.UpdatedAt = now
+		var tx transaction
+		if err := addUser(conn, &tx, &newUser); err != nil {
+			return nil, err
+		}
+		return tx, nil
+	})
+	if err != nil || !created {
+		return false, err
+	}
+	user.ID = id
+	user.Version = 1
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	return true, nil
+}
+
+//addUser queues the writes of a new user, its hash, attributes and indexes. It
+//is called inside watch with the user key watched.
+func addUser(conn redis.Conn, tx *transaction, user *User) error {
+	userKey := userKeyPrefix + strconv.Itoa(user.ID)
+	if err := updateIndexes(conn, tx, user.ID, nil, user); err != nil {
 		return err
 	}
+	tx.add("HMSET", redis.Args{}.Add(userKey).AddFlat(user)...)
+	if len(user.Attributes) > 0 {
+		tx.add("HMSET", redis.Args{}.Add(userKey+attributesKeySuffix).AddFlat(user.Attributes)...)
+	}
+	tx.add("ZADD", userIndexKey, user.ID, user.ID)
 	return nil
 }
 
-//getNewUserID is to use userIncrID as an auto increment key for userID
-func getNewUserID(conn redis.Conn) (int, error) {
-	var (
-		key    = "userIncrID"
-		id     int
-		err    error
-		exists int
-	)
-
-	exists, err = redis.Int(conn.Do("EXISTS", key))
+//UpdateUser applies fn to the stored user and writes back only the fields fn
+//changed, bumping the version and UpdatedAt of the user if there were any. The
+//ID, version and timestamps cannot be changed by fn. The update is atomic: if
+//the user is modified or deleted concurrently, fn is applied again to the new
+//state
+func UpdateUser(conn redis.Conn, userID int, fn func(user *User) error) (*User, error) {
+	userKey := userKeyPrefix + strconv.Itoa(userID)
+	var updated User
+	err := watch(conn, userKey, func() (transaction, error) {
+		current, err := FindUserByID(conn, userID)
+		if err != nil {
+			return nil, err
+		}
+		updated = *current
+		updated.Attributes = copyAttributes(current.Attributes)
+		if err := fn(&updated); err != nil {
+			return nil, err
+		}
+		updated.ID = current.ID
+		updated.Version = current.Version
+		updated.CreatedAt = current.CreatedAt
+		updated.UpdatedAt = current.UpdatedAt
+		fields := changedFields(current, &updated)
+		attributesChanged := !sameAttributes(current.Attributes, updated.Attributes)
+		var tx transaction
+		if len(fields) > 0 || attributesChanged {
+			updated.Version++
+			updated.UpdatedAt = timestamp(time.Now())
+			fields = fields.Add("version", updated.Version, "updated_at", updated.UpdatedAt)
+			tx.add("HMSET", redis.Args{}.Add(userKey).AddFlat(fields)...)
+		}
+		if err := updateIndexes(conn, &tx, userID, current, &updated); err != nil {
+			return nil, err
+		}
+		if attributesChanged {
+			tx.add("DEL", userKey+attributesKeySuffix)
+			if len(updated.Attributes) > 0 {
+				tx.add("HMSET", redis.Args{}.Add(userKey+attributesKeySuffix).AddFlat(updated.Attributes)...)
+			}
+		}
+		return tx, nil
+	})
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	//if userIncrID is not set, set to 1 as initial id
-	if exists == 0 {
-		_, err = redis.String(conn.Do("SET", key, 1))
-		if err != nil {
-			return 0, err
+	return &updated, nil
+}
+
+//changedFields returns the redis field/value pairs of updated that differ from current
+func changedFields(current, updated *User) redis.Args {
+	before := redis.Args{}.AddFlat(current)
+	after := redis.Args{}.AddFlat(updated)
+	var fields redis.Args
+	for i := 0; i < len(after); i += 2 {
+		if fmt.Sprint(before[i+1]) != fmt.Sprint(after[i+1]) {
+			fields = append(fields, after[i], after[i+1])
 		}
-		return 1, nil
 	}
+	return fields
+}
 
-	id, err = redis.Int(conn.Do("INCR", key))
-	if err != nil {
-		return 0, err
+//sameAttributes reports whether a and b hold the same attributes, a nil and an
+//empty map being the same
+func sameAttributes(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+//copyAttributes copies attributes so changing the copy leaves them as they are
+func copyAttributes(attributes map[string]string) map[string]string {
+	if len(attributes) == 0 {
+		return nil
+	}
+	copied := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		copied[key] = value
+	}
+	return copied
+}
+
+//timestamp is t as stored in CreatedAt and UpdatedAt
+func timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func DeleteUser(conn redis.Conn, userID int, opts DeleteOptions) error {
+	userKey := userKeyPrefix + strconv.Itoa(userID)
+	return watch(conn, userKey, func() (transaction, error) {
+		values, err := redis.Values(conn.Do("HGETALL", userKey))
+		if err != nil {
+			return nil, err
+		}
+		//a hard delete also purges users that were soft-deleted before
+		if len(values) == 0 || (opts.Soft && isDeleted(values)) {
+			return nil, ErrNoUserFound
+		}
+		user, err := scanUser(values)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.matchVersion(user.Version) {
+			return nil, ErrVersionMismatch
+		}
+		var tx transaction
+		//soft-deleted users were already taken out of the indexes
+		if !isDeleted(values) {
+			if err := updateIndexes(conn, &tx, userID, user, nil); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Soft {
+			tx.add("HSET", userKey, deletedAtField, time.Now().Unix())
+		} else {
+			tx.add("DEL", userKey, userKey+attributesKeySuffix)
+		}
+		tx.add("ZREM", userIndexKey, userID)
+		return tx, nil
+	})
+}
+
+//isDeleted checks HGETALL values of a user hash for the soft-delete marker
+func isDeleted(values []interface{}) bool {
+	for i := 0; i < len(values); i += 2 {
+		if field, ok := values[i].([]byte); ok && string(field) == deletedAtField {
+			return true
+		}
 	}
-	return id, nil
+	return false
+}
+
+//getNewUserID is to use userIncrID as an auto increment key for userID,
+//INCR is atomic so concurrent creates never get the same ID
+func getNewUserID(conn redis.Conn) (int, error) {
+	return redis.Int(conn.Do("INCR", userIncrIDKey))
 }
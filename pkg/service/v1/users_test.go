@@ -3,6 +3,10 @@ package v1
 import (
 	"encoding/json"
 	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/alicebob/miniredis"
@@ -18,6 +22,9 @@ func loadInitUserData(conn redis.Conn) error {
 	if _, err := conn.Do("HMSET", redis.Args{}.Add("user:2").AddFlat(user2)...); err != nil {
 		return err
 	}
+	if _, err := conn.Do("ZADD", "users:ids", 1, 1, 2, 2); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -37,7 +44,7 @@ func TestListAllUsersSuccess(t *testing.T) {
 	users, err := ListAllUsers(conn)
 	var expectErr error
 	resp, _ := json.Marshal(users)
-	expectResp := `[{"ID":1,"Name":"John","Age":31,"City":"New York"},{"ID":2,"Name":"Doe","Age":22,"City":"Vancouver"}]`
+	expectResp := `[{"ID":1,"Name":"John","Age":31,"City":"New York","Email":"","Phone":"","Version":1,"CreatedAt":0,"UpdatedAt":0,"Attributes":null},{"ID":2,"Name":"Doe","Age":22,"City":"Vancouver","Email":"","Phone":"","Version":1,"CreatedAt":0,"UpdatedAt":0,"Attributes":null}]`
 	if err != expectErr {
 		t.Errorf("error: got %s, expected %s", err.Error(), expectErr.Error())
 	}
@@ -84,7 +91,7 @@ func TestFindUserByIDSuccess(t *testing.T) {
 	user, err := FindUserByID(conn, 1)
 	var expectErr error
 	resp, _ := json.Marshal(user)
-	expectResp := `{"ID":1,"Name":"John","Age":31,"City":"New York"}`
+	expectResp := `{"ID":1,"Name":"John","Age":31,"City":"New York","Email":"","Phone":"","Version":1,"CreatedAt":0,"UpdatedAt":0,"Attributes":null}`
 	if err != expectErr {
 		t.Errorf("error: got %s, expected %s", err.Error(), expectErr.Error())
 	}
@@ -237,3 +244,833 @@ func TestCreateOrUpdateUserNotFound(t *testing.T) {
 		t.Errorf("error: got %s, expected %s", err.Error(), ErrNoUserFound)
 	}
 }
+
+func TestListAllUsersMultiDigitIDs(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("SET", "userIncrID", 9); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"John", "Doe"} {
+		if err := CreateOrUpdateUser(conn, &User{Name: name, Age: 31, City: "New York"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if len(users) != 2 || users[0].ID != 10 || users[0].Name != "John" || users[1].ID != 11 || users[1].Name != "Doe" {
+		t.Errorf("ListAllUsers() = %v, expect John with ID 10 then Doe with ID 11", users)
+	}
+}
+
+func TestListAllUsersSkipsStaleIndexEntries(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("ZADD", "users:ids", 3, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if len(users) != 2 {
+		t.Errorf("ListAllUsers() returned %d users, expect 2", len(users))
+	}
+}
+
+func TestIndexExistingUsers(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 150; i++ {
+		key := "user:" + strconv.Itoa(i)
+		if _, err := conn.Do("HMSET", key, "id", i, "name", "John"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := conn.Do("SET", "userIncrID", 150); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 150 {
+		t.Errorf("ListAllUsers() returned %d users, expect 150", len(users))
+	}
+	if users[149].ID != 150 {
+		t.Errorf("last user ID = %d, expect 150", users[149].ID)
+	}
+}
+
+func TestIndexExistingUsersRunsOnce(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HMSET", "user:1", "id", 1, "name", "John", "city", "Rome"); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if !s.Exists("users:indexed") {
+		t.Errorf("users:indexed: not set once the users are indexed")
+	}
+
+	//a hash changed behind the store is not indexed again
+	if _, err := conn.Do("HMSET", "user:1", "city", "Paris"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HMSET", "user:2", "id", 2, "name", "Doe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if s.Exists("users:city:paris") {
+		t.Errorf("users:city:paris: indexed by a second migration")
+	}
+	if count, _ := CountUsers(conn); count != 1 {
+		t.Errorf("CountUsers() = %d, expect only the user of the first migration", count)
+	}
+}
+
+func TestIndexExistingUsersEmails(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HMSET", "user:1", "id", 1, "name", "John", "email", "John@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("HMSET", "user:2", "id", 2, "name", "Doe", "email", "doe@example.com", "deleted_at", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	user, err := FindUserByEmail(conn, "john@example.com")
+	if err != nil || user.ID != 1 {
+		t.Errorf("FindUserByEmail() = %+v, %v, expect user 1", user, err)
+	}
+	if _, err := FindUserByEmail(conn, "doe@example.com"); err != ErrNoUserFound {
+		t.Errorf("error: got %v, expected the email of a deleted user left out", err)
+	}
+}
+
+func TestChangeEmailIndex(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Name: "John", Email: "john@example.com"}
+	if err := CreateOrUpdateUser(conn, user); err != nil {
+		t.Fatal(err)
+	}
+	user.Email = "John@example.net"
+	user.Version = 0
+	if err := CreateOrUpdateUser(conn, user); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("users:email:john@example.com") {
+		t.Errorf("users:email:john@example.com: got %v, expected the old email removed", s.Exists("users:email:john@example.com"))
+	}
+	if id, _ := s.Get("users:email:john@example.net"); id != strconv.Itoa(user.ID) {
+		t.Errorf("users:email:john@example.net: got %q, expected %d", id, user.ID)
+	}
+}
+
+func TestDeleteUserSuccess(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DeleteUser(conn, 1, DeleteOptions{})
+	if err != nil {
+		t.Errorf("error: got %s, expected no error", err.Error())
+	}
+	if s.Exists("user:1") {
+		t.Errorf("user:1 still exists after a hard delete")
+	}
+	if _, err = FindUserByID(conn, 1); err != ErrNoUserFound {
+		t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+	}
+}
+
+func TestDeleteUserNotFound(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []DeleteOptions{{}, {Soft: true}} {
+		err = DeleteUser(conn, 4, opts)
+		if err != ErrNoUserFound {
+			t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+		}
+	}
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = DeleteUser(conn, 1, DeleteOptions{Soft: true})
+	if err != nil {
+		t.Errorf("error: got %s, expected no error", err.Error())
+	}
+	if !s.Exists("user:1") {
+		t.Errorf("user:1 was removed by a soft delete")
+	}
+	if _, err = FindUserByID(conn, 1); err != ErrNoUserFound {
+		t.Errorf("FindUserByID() error: got %v, expected %s", err, ErrNoUserFound)
+	}
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].ID != 2 {
+		t.Errorf("ListAllUsers() = %v, expect only user 2", users)
+	}
+	if err = CreateOrUpdateUser(conn, &User{ID: 1, Name: "John"}); err != ErrNoUserFound {
+		t.Errorf("CreateOrUpdateUser() error: got %v, expected %s", err, ErrNoUserFound)
+	}
+	if err = DeleteUser(conn, 1, DeleteOptions{Soft: true}); err != ErrNoUserFound {
+		t.Errorf("DeleteUser() error: got %v, expected %s", err, ErrNoUserFound)
+	}
+	if err = IndexExistingUsers(conn); err != nil {
+		t.Fatal(err)
+	}
+	if users, _ = ListAllUsers(conn); len(users) != 1 {
+		t.Errorf("IndexExistingUsers() brought back a soft-deleted user")
+	}
+
+	//a hard delete purges the soft-deleted hash
+	if err = DeleteUser(conn, 1, DeleteOptions{}); err != nil {
+		t.Errorf("error: got %s, expected no error", err.Error())
+	}
+	if s.Exists("user:1") {
+		t.Errorf("user:1 still exists after being purged")
+	}
+}
+
+func TestUpdateUserFields(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := UpdateUser(conn, 1, func(user *User) error {
+		user.ID = 7
+		user.Age = 32
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if user.UpdatedAt == 0 {
+		t.Errorf("UpdateUser().UpdatedAt not set")
+	}
+	expectUser := User{ID: 1, Name: "John", Age: 32, City: "New York", Version: 2, UpdatedAt: user.UpdatedAt}
+	if !reflect.DeepEqual(*user, expectUser) {
+		t.Errorf("UpdateUser() = %+v, expect %+v", *user, expectUser)
+	}
+	if age := s.HGet("user:1", "age"); age != "32" {
+		t.Errorf("stored age = %s, expect 32", age)
+	}
+	if s.Exists("user:7") {
+		t.Errorf("UpdateUser() changed the ID of the user")
+	}
+}
+
+func TestUpdateUserAborted(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectErr := errors.New("rejected")
+	_, err = UpdateUser(conn, 1, func(user *User) error {
+		user.Age = 32
+		return expectErr
+	})
+	if err != expectErr {
+		t.Errorf("error: got %v, expected %s", err, expectErr)
+	}
+	if age := s.HGet("user:1", "age"); age != "31" {
+		t.Errorf("stored age = %s, expect 31", age)
+	}
+
+	_, err = UpdateUser(conn, 4, func(user *User) error { return nil })
+	if err != ErrNoUserFound {
+		t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+	}
+}
+
+func TestCreateUserSkipsTakenIDs(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Jane", Age: 40, City: "Toronto"}
+	err = CreateOrUpdateUser(conn, user)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if user.ID != 3 {
+		t.Errorf("user.ID = %d, expect 3", user.ID)
+	}
+	if name := s.HGet("user:1", "name"); name != "John" {
+		t.Errorf("user:1 name = %s, expect John to be left alone", name)
+	}
+}
+
+func TestCreateUsersConcurrently(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	defer pool.Close()
+
+	const creates = 50
+	ids := make(chan int, creates)
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := pool.Get()
+			defer conn.Close()
+			user := &User{Name: "John", Age: 31, City: "New York"}
+			if err := CreateOrUpdateUser(conn, user); err != nil {
+				t.Errorf("error: got %s, expected no error", err.Error())
+				return
+			}
+			ids <- user.ID
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[int]bool)
+	for id := range ids {
+		if seen[id] {
+			t.Errorf("user ID %d was allocated twice", id)
+		}
+		seen[id] = true
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != creates {
+		t.Errorf("ListAllUsers() returned %d users, expect %d", len(users), creates)
+	}
+}
+
+func TestCreateUsersConcurrentlySameEmail(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", s.Addr())
+		},
+	}
+	defer pool.Close()
+
+	const creates = 20
+	var created, taken int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < creates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn := pool.Get()
+			defer conn.Close()
+			err := CreateOrUpdateUser(conn, &User{Name: "John", Email: "john@example.com"})
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				created++
+			case ErrEmailTaken:
+				taken++
+			default:
+				t.Errorf("error: got %s, expected none or %s", err.Error(), ErrEmailTaken)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || taken != creates-1 {
+		t.Errorf("got %d users created and %d rejected, expect 1 and %d", created, taken, creates-1)
+	}
+}
+
+func TestUpdateUserConcurrentDelete(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	_, err = UpdateUser(conn, 1, func(user *User) error {
+		calls++
+		//another client deletes the user between the read and the write
+		if err := DeleteUser(other, 1, DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		user.Age = 32
+		return nil
+	})
+	if err != ErrNoUserFound {
+		t.Errorf("error: got %v, expected %s", err, ErrNoUserFound)
+	}
+	if calls != 1 {
+		t.Errorf("fn called %d times, expect 1", calls)
+	}
+	if s.Exists("user:1") {
+		t.Errorf("UpdateUser() resurrected a deleted user")
+	}
+}
+
+func TestUpdateUserRetriesOnConflict(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadInitUserData(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	user, err := UpdateUser(conn, 1, func(user *User) error {
+		calls++
+		if calls == 1 {
+			if _, err := other.Do("HSET", "user:1", "city", "Boston"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		user.Age++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, expect 2", calls)
+	}
+	if user.UpdatedAt == 0 {
+		t.Errorf("UpdateUser().UpdatedAt not set")
+	}
+	expectUser := User{ID: 1, Name: "John", Age: 32, City: "Boston", Version: 2, UpdatedAt: user.UpdatedAt}
+	if !reflect.DeepEqual(*user, expectUser) {
+		t.Errorf("UpdateUser() = %+v, expect %+v", *user, expectUser)
+	}
+}
+
+func TestFindUserByIDLegacyHash(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	s.HSet("user:2:attrs", "team", "core")
+
+	user, err := FindUserByID(conn, 1)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if user.Email != "" || user.CreatedAt != 0 || user.Attributes != nil {
+		t.Errorf("FindUserByID() = %+v, expect the new fields empty", user)
+	}
+	users, err := ListAllUsers(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Attributes != nil || users[1].Attributes["team"] != "core" {
+		t.Errorf("ListAllUsers() = %v, expect the attributes of user 2 only", users)
+	}
+
+	if err := DeleteUser(conn, 2, DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("user:2:attrs") {
+		t.Errorf("user:2:attrs still exists after the user was purged")
+	}
+}
+
+func TestFilterIndexes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &User{Name: "Jane", Age: 28, City: "Vancouver"}
+	if err := CreateOrUpdateUser(conn, user); err != nil {
+		t.Fatal(err)
+	}
+	if score, err := s.ZScore("users:age", "1"); err != nil || score != 28 {
+		t.Errorf("age index: got %v, %v, expected 28", score, err)
+	}
+	if ok, _ := s.IsMember("users:city:vancouver", "1"); !ok {
+		t.Errorf("city index: user 1 missing from users:city:vancouver")
+	}
+	if members, _ := s.ZMembers("users:name"); !reflect.DeepEqual(members, []string{"jane\x001"}) {
+		t.Errorf("name index: got %q, expected the lowercase name and ID", members)
+	}
+
+	if _, err := UpdateUser(conn, 1, func(user *User) error {
+		user.City = "Toronto"
+		user.Name = "Janet"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("users:city:vancouver") {
+		t.Errorf("city index: user 1 left in users:city:vancouver")
+	}
+	if members, _ := s.ZMembers("users:name"); !reflect.DeepEqual(members, []string{"janet\x001"}) {
+		t.Errorf("name index: got %q, expected only the new name", members)
+	}
+
+	if err := DeleteUser(conn, 1, DeleteOptions{Soft: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"users:age", "users:city:toronto", "users:name"} {
+		if s.Exists(key) {
+			t.Errorf("%s: deleted user left in the index", key)
+		}
+	}
+}
+
+func TestIndexExistingUsersFilters(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	maxAge := 30
+	page, err := ListUsers(conn, ListOptions{Filter: Filter{MaxAge: &maxAge, City: "vancouver"}})
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if len(page.Users) != 1 || page.Users[0].Name != "Doe" {
+		t.Errorf("ListUsers() = %+v, expect Doe", page.Users)
+	}
+}
+
+func TestSearchIndexes(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := IndexExistingUsers(conn); err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	results, err := SearchUsers(conn, "vancuover", 0)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if len(results) != 1 || results[0].User.ID != 2 || results[0].Highlights["city"] != "<em>Vancouver</em>" {
+		t.Errorf("SearchUsers() = %+v, expect Doe found by a typo", results)
+	}
+	for _, key := range s.Keys() {
+		if strings.HasPrefix(key, "users:searchtmp:") {
+			t.Errorf("%s: temporary key left behind by the search", key)
+		}
+	}
+	if s.Exists("users:search:va") {
+		t.Errorf("users:search:va: prefix shorter than %d indexed", minPrefixLength)
+	}
+
+	if err := DeleteUser(conn, 2, DeleteOptions{Soft: true}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"users:search:van", "users:search:vancouver", "users:words:vancouver", "users:words:doe"} {
+		if s.Exists(key) {
+			t.Errorf("%s: deleted user left in the index", key)
+		}
+	}
+}
+
+func TestUserStatsCountsExistingUsersOnce(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+	//a second start finds the migration done
+	for i := 0; i < 2; i++ {
+		if err := IndexExistingUsers(conn); err != nil {
+			t.Fatalf("error: got %s, expected no error", err.Error())
+		}
+	}
+	stats, err := UserStats(conn)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	if stats.Total != 2 || stats.MeanAge != 26.5 || stats.Cities["vancouver"] != 1 {
+		t.Errorf("UserStats() = %+v, expect the 2 users counted once", stats)
+	}
+
+	if err := DeleteUser(conn, 2, DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if cities, _ := s.SortedSet("users:stats:cities"); !reflect.DeepEqual(cities, map[string]float64{"new york": 1}) {
+		t.Errorf("users:stats:cities = %v, expect the city without users removed", cities)
+	}
+}
+
+// hookConn runs hook once after the first command named cmd it sends with Do
+type hookConn struct {
+	redis.Conn
+	cmd  string
+	hook func()
+}
+
+func (c *hookConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if cmd == c.cmd && c.hook != nil {
+		hook := c.hook
+		c.hook = nil
+		hook()
+	}
+	return reply, err
+}
+
+func TestListUsersSortedTiesConcurrentCreate(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	conn, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := redis.Dial("tcp", s.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []int{10, 20, 30, 40, 50} {
+		if err := CreateOrUpdateUser(conn, &User{Name: "John", Age: age}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//another client adds a younger user between the values of the page and
+	//its ties are read, so the users before the page outnumber the offset
+	hooked := &hookConn{Conn: conn, cmd: "ZRANGEBYSCORE", hook: func() {
+		if err := CreateOrUpdateUser(other, &User{Name: "Jane", Age: 5}); err != nil {
+			t.Fatal(err)
+		}
+	}}
+	sort, _ := ParseSort("age,name")
+	page, err := ListUsers(hooked, ListOptions{Limit: 2, Cursor: encodeOffsetCursor(2), Sort: sort})
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	var ages []int
+	for _, user := range page.Users {
+		ages = append(ages, user.Age)
+	}
+	if !reflect.DeepEqual(ages, []int{20, 30}) {
+		t.Errorf("ListUsers() ages = %v, expect [20 30] read again with the new user", ages)
+	}
+}
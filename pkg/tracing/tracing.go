@@ -0,0 +1,89 @@
+// Package tracing sets up OpenTelemetry tracing with W3C trace context
+// propagation and an exporter chosen by name, so traces can be collected
+// without a network connection.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName is the service.name resource attribute of every span
+const ServiceName = "go-rest"
+
+// ExporterFactory creates an exporter writing to dest, whose meaning depends
+// on the exporter, such as a file path
+type ExporterFactory func(dest string) (sdktrace.SpanExporter, error)
+
+var (
+	exportersMu sync.RWMutex
+	exporters   = map[string]ExporterFactory{
+		//stdout is shared with the JSON logs, stderr keeps the spans apart
+		"stdout": func(dest string) (sdktrace.SpanExporter, error) {
+			return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		},
+		"stderr": func(dest string) (sdktrace.SpanExporter, error) {
+			return stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+		},
+		"file": newFileExporter,
+	}
+)
+
+// RegisterExporter makes an exporter available to Setup under name
+func RegisterExporter(name string, factory ExporterFactory) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	exporters[name] = factory
+}
+
+// Exporters lists the names accepted by Setup, besides none
+func Exporters() []string {
+	exportersMu.RLock()
+	defer exportersMu.RUnlock()
+	names := make([]string, 0, len(exporters))
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Setup installs the global tracer provider exporting spans with the named
+// exporter, and the W3C trace context and baggage propagators. The returned
+// function flushes the pending spans and releases the exporter. With the none
+// exporter spans are still created and propagated but never exported.
+func Setup(exporter, dest string) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", ServiceName))),
+	}
+	if exporter != "none" {
+		exportersMu.RLock()
+		factory, ok := exporters[exporter]
+		exportersMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+		}
+		spanExporter, err := factory(dest)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(spanExporter))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetupFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	shutdown, err := Setup("file", path)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	ctx, parent := otel.Tracer("test").Start(context.Background(), "parent")
+	_, span := otel.Tracer("test").Start(ctx, "test span", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("db.rows", 2), attribute.StringSlice("db.keys", []string{"a", "b"})))
+	span.SetStatus(codes.Error, "failed")
+	span.End()
+	parent.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request otlpTraceRequest
+	if err := json.Unmarshal(content, &request); err != nil {
+		t.Fatalf("exported spans %s: not a line of OTLP JSON: %v", content, err)
+	}
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("exported spans %s: expected a resource with a scope", content)
+	}
+	resource := request.ResourceSpans[0].Resource
+	if !reflect.DeepEqual(resource.Attributes, []otlpKeyValue{{Key: "service.name", Value: otlpValue(attribute.StringValue(ServiceName))}}) {
+		t.Errorf("resource attributes = %+v, expect the service name", resource.Attributes)
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported spans %s: expected 2 spans", content)
+	}
+	got := spans[0]
+	if got.Name != "test span" || got.TraceID != span.SpanContext().TraceID().String() || got.ParentSpanID != parent.SpanContext().SpanID().String() {
+		t.Errorf("span = %+v, expect the child of parent", got)
+	}
+	if got.Kind != 3 || got.Status != (otlpStatus{Code: 2, Message: "failed"}) {
+		t.Errorf("span kind %d and status %+v, expect the OTLP client kind 3 and error code 2", got.Kind, got.Status)
+	}
+	for _, expected := range []string{`"intValue":"2"`, `"arrayValue":{"values":[{"stringValue":"a"},{"stringValue":"b"}]}`, `"startTimeUnixNano":"`} {
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("exported spans %s: expected %s", content, expected)
+		}
+	}
+}
+
+func TestSetupPropagation(t *testing.T) {
+	shutdown, err := Setup("none", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shutdown(context.Background())
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+	_, span := otel.Tracer("test").Start(ctx, "child")
+	defer span.End()
+	if traceID := span.SpanContext().TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID: got %s, expected the one of the traceparent header", traceID)
+	}
+}
+
+func TestExporters(t *testing.T) {
+	expected := []string{"file", "stderr", "stdout"}
+	if names := Exporters(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("Exporters() = %v, expect %v", names, expected)
+	}
+}
+
+func TestSetupUnknownExporter(t *testing.T) {
+	if _, err := Setup("carrier-pigeon", ""); err == nil {
+		t.Errorf("error: got nil, expected an unknown exporter error")
+	}
+	if _, err := Setup("file", ""); err == nil {
+		t.Errorf("error: got nil, expected a missing file path error")
+	}
+}
@@ -0,0 +1,153 @@
+// Package validation collects field errors for request payloads so a handler can
+// report every problem with a payload at once.
+package validation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// FieldError describes why the value of a single field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors is the list of field errors found in a payload, it is an error itself.
+type Errors []FieldError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldErr := range e {
+		messages[i] = fieldErr.Field + ": " + fieldErr.Message
+	}
+	return "validation failed: " + strings.Join(messages, "; ")
+}
+
+// Add records an error for field.
+func (e *Errors) Add(field, message string) {
+	*e = append(*e, FieldError{Field: field, Message: message})
+}
+
+// Err returns nil when no error was recorded, so a validator can end with
+// `return errs.Err()` without returning a non-nil empty list.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Required rejects empty or blank strings.
+func (e *Errors) Required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		e.Add(field, "is required")
+	}
+}
+
+// MaxLength rejects strings longer than max characters.
+func (e *Errors) MaxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		e.Add(field, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
+
+// Range rejects numbers outside of [min, max].
+func (e *Errors) Range(field string, value, min, max int) {
+	if value < min || value > max {
+		e.Add(field, fmt.Sprintf("must be between %d and %d", min, max))
+	}
+}
+
+// Email rejects strings that are not a bare email address, an empty string is
+// accepted so optional fields can use it.
+func (e *Errors) Email(field, value string) {
+	if value == "" {
+		return
+	}
+	if addr, err := mail.ParseAddress(value); err != nil || addr.Address != value {
+		e.Add(field, "must be an email address")
+	}
+}
+
+// Phone rejects strings that are not a phone number of 7 to 15 digits, which
+// may start with + and be grouped by spaces, dots, dashes or parentheses. An
+// empty string is accepted so optional fields can use it.
+func (e *Errors) Phone(field, value string) {
+	if value == "" {
+		return
+	}
+	digits := 0
+	for i, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case r == '+' && i == 0, strings.ContainsRune(" .-()", r):
+		default:
+			e.Add(field, "must be a phone number")
+			return
+		}
+	}
+	if digits < 7 || digits > 15 {
+		e.Add(field, "must be a phone number")
+	}
+}
+
+// ErrTrailingData is returned for a payload followed by more than white space,
+// such as a second JSON value.
+var ErrTrailingData = errors.New("the request body must hold a single JSON value")
+
+// Validator is implemented by payloads that can check their own fields.
+type Validator interface {
+	Validate() error
+}
+
+// DecodeJSON decodes r into v rejecting unknown fields and trailing data, then
+// validates v. Unknown fields and values of the wrong type are reported as
+// Errors, like the errors of Validate, while malformed JSON is returned as is.
+func DecodeJSON(r io.Reader, v Validator) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		//keep read errors, such as a body over its size limit
+		var syntaxErr *json.SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			return err
+		}
+		return ErrTrailingData
+	}
+	return v.Validate()
+}
+
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return Errors{{Field: typeErr.Field, Message: "must be a " + typeName(typeErr.Type.Kind().String())}}
+	}
+	//encoding/json has no typed error for unknown fields
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		field := strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		return Errors{{Field: field, Message: "is not a known field"}}
+	}
+	return err
+}
+
+func typeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "map" || kind == "struct":
+		return "object"
+	case kind == "slice" || kind == "array":
+		return "list"
+	}
+	return kind
+}
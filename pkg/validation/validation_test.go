@@ -0,0 +1,106 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+)
+
+type payload struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+func (p *payload) Validate() error {
+	var errs Errors
+	errs.Required("name", p.Name)
+	errs.MaxLength("name", p.Name, 5)
+	errs.Range("age", p.Age, 0, 150)
+	return errs.Err()
+}
+
+func TestErrNoErrors(t *testing.T) {
+	var errs Errors
+	if err := errs.Err(); err != nil {
+		t.Errorf("Err() = %v, expect nil", err)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		body   string
+		expect string
+	}{
+		{`{"name": "John", "age": 31}`, ""},
+		{`{"name": "", "age": 151}`, "validation failed: name: is required; age: must be between 0 and 150"},
+		{`{"name": "Johnny", "age": -1}`, "validation failed: name: must be at most 5 characters; age: must be between 0 and 150"},
+		{`{"name": "John", "age": "31"}`, "validation failed: age: must be a number"},
+		{`{"name": "John", "city": "Vancouver"}`, "validation failed: city: is not a known field"},
+	}
+	for _, test := range tests {
+		var p payload
+		err := DecodeJSON(strings.NewReader(test.body), &p)
+		if test.expect == "" {
+			if err != nil {
+				t.Errorf("DecodeJSON(%s) error: got %s, expected no error", test.body, err.Error())
+			}
+			continue
+		}
+		if _, ok := err.(Errors); !ok {
+			t.Errorf("DecodeJSON(%s) error: got %T, expected Errors", test.body, err)
+			continue
+		}
+		if err.Error() != test.expect {
+			t.Errorf("DecodeJSON(%s) error: got %s, expected %s", test.body, err.Error(), test.expect)
+		}
+	}
+}
+
+func TestEmailAndPhone(t *testing.T) {
+	tests := []struct {
+		email  string
+		phone  string
+		expect string
+	}{
+		{"", "", ""},
+		{"doe@example.com", "+1 (604) 555-0100", ""},
+		{"doe", "555", "validation failed: email: must be an email address; phone: must be a phone number"},
+		{"Doe <doe@example.com>", "1-800-FLOWERS", "validation failed: email: must be an email address; phone: must be a phone number"},
+		{"doe@example.com", "12+3456789", "validation failed: phone: must be a phone number"},
+	}
+	for _, test := range tests {
+		var errs Errors
+		errs.Email("email", test.email)
+		errs.Phone("phone", test.phone)
+		err := errs.Err()
+		if test.expect == "" && err != nil {
+			t.Errorf("%q, %q error: got %s, expected no error", test.email, test.phone, err.Error())
+		}
+		if test.expect != "" && (err == nil || err.Error() != test.expect) {
+			t.Errorf("%q, %q error: got %v, expected %s", test.email, test.phone, err, test.expect)
+		}
+	}
+}
+
+func TestDecodeJSONMalformed(t *testing.T) {
+	var p payload
+	err := DecodeJSON(strings.NewReader(`{"name": "Jo`), &p)
+	if err == nil {
+		t.Fatal("error: got nil, expected a syntax error")
+	}
+	if _, ok := err.(Errors); ok {
+		t.Errorf("error: got %v, expected a syntax error", err)
+	}
+}
+
+func TestDecodeJSONTrailingData(t *testing.T) {
+	for _, body := range []string{`{"name": "John"} garbage`, `{"name": "John"}{"name": "Jane"}`, `{"name": "John"}}`} {
+		var p payload
+		if err := DecodeJSON(strings.NewReader(body), &p); err != ErrTrailingData {
+			t.Errorf("DecodeJSON(%s) error: got %v, expected %v", body, err, ErrTrailingData)
+		}
+	}
+	var p payload
+	if err := DecodeJSON(strings.NewReader("{\"name\": \"John\"}\n"), &p); err != nil {
+		t.Errorf("trailing new line: error: got %s, expected no error", err.Error())
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/rnidev/go-rest/pkg/auth"
+	"github.com/rnidev/go-rest/pkg/config"
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/ratelimit"
+)
+
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// EnableRateLimit limits the request rate of each client on the user routes as
+// set in cfg, nothing is limited when cfg sets no limit
+func (app *App) EnableRateLimit(cfg config.RateLimitConfig) {
+	app.rateLimits = cfg
+	app.limiter = ratelimit.NewLimiter(app.pool)
+}
+
+// rateLimitIP counts the request in the bucket of its IP address before it is
+// authenticated, so a client cannot try credentials at any rate
+func (app *App) rateLimitIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.limiter == nil || app.rateLimits.IP.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if app.allow(w, r, "ip:"+clientIP(r), app.rateLimits.IP) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// rateLimit counts the request in the bucket of its client and route, once the
+// client is authenticated
+func (app *App) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.limiter == nil || !app.rateLimits.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := r.Method + " " + routeTemplate(r)
+		client, subject := rateLimitClient(r)
+		limit := app.routeLimit(route, routeTemplate(r), subject)
+		if limit.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if app.allow(w, r, route+":"+client, limit) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// allow takes a token from the bucket at key, and rejects the request with 429
+// Too Many Requests once the bucket is empty. Requests are let through when
+// Redis cannot be reached, so an outage of the limiter does not become an
+// outage of the API.
+func (app *App) allow(w http.ResponseWriter, r *http.Request, key string, limit ratelimit.Limit) bool {
+	result, err := app.limiter.Allow(r.Context(), key, limit)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("rate limiter unavailable", slog.String("error", err.Error()))
+		return true
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", seconds(result.Reset))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", seconds(result.RetryAfter))
+		renderErrorResp(w, r, ErrRateLimited)
+		return false
+	}
+	return true
+}
+
+// routeLimit picks the limit of subject, else the one of the route by method
+// and template, else the one of the template, else the default
+func (app *App) routeLimit(route, template, subject string) ratelimit.Limit {
+	if limit, ok := app.rateLimits.Subjects[subject]; ok && subject != "" {
+		return limit
+	}
+	if limit, ok := app.rateLimits.Routes[route]; ok {
+		return limit
+	}
+	if limit, ok := app.rateLimits.Routes[template]; ok {
+		return limit
+	}
+	return app.rateLimits.Default
+}
+
+// rateLimitClient identifies the client of r by its authenticated subject, or
+// else by its IP address
+func rateLimitClient(r *http.Request) (client, subject string) {
+	if principal := auth.FromContext(r.Context()); principal != nil && principal.Subject != "" {
+		return principal.Method + ":" + principal.Subject, principal.Subject
+	}
+	return "ip:" + clientIP(r), ""
+}
+
+// clientIP is the IP address r comes from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// seconds rounds d up to whole seconds, as the RateLimit headers expect
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rnidev/go-rest/pkg/config"
+	"github.com/rnidev/go-rest/pkg/logging"
+	"github.com/rnidev/go-rest/pkg/ratelimit"
+)
+
+func TestRateLimit(t *testing.T) {
+	app := setup()
+	app.EnableRateLimit(config.RateLimitConfig{
+		Default: ratelimit.Limit{Requests: 2, Per: time.Minute},
+		Routes:  map[string]ratelimit.Limit{"GET /user/{id:[0-9]+}": {Requests: 1, Per: time.Minute}},
+	})
+
+	tests := []struct {
+		path      string
+		addr      string
+		status    int
+		remaining string
+	}{
+		{"/users", "10.0.0.1:1234", http.StatusOK, "1"},
+		{"/users", "10.0.0.1:1235", http.StatusOK, "0"},
+		{"/users", "10.0.0.1:1236", http.StatusTooManyRequests, "0"},
+		{"/users", "10.0.0.2:1234", http.StatusOK, "1"},
+		{"/user/124", "10.0.0.1:1234", http.StatusNotFound, "0"},
+		{"/user/124", "10.0.0.1:1234", http.StatusTooManyRequests, "0"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.path, nil)
+		req.RemoteAddr = test.addr
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("%s from %s: http status code: got %v, expected %v", test.path, test.addr, rr.Code, test.status)
+		}
+		if remaining := rr.Header().Get("RateLimit-Remaining"); remaining != test.remaining {
+			t.Errorf("%s from %s: RateLimit-Remaining: got %q, expected %q", test.path, test.addr, remaining, test.remaining)
+		}
+		if test.status == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s from %s: Retry-After missing", test.path, test.addr)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Request-ID", "test-request")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if limit := rr.Header().Get("RateLimit-Limit"); limit != "2" {
+		t.Errorf("RateLimit-Limit: got %q, expected 2", limit)
+	}
+	if reset := rr.Header().Get("RateLimit-Reset"); reset != "60" {
+		t.Errorf("RateLimit-Reset: got %q, expected 60", reset)
+	}
+	expected := `{"type":"/problems/rate-limited","title":"Rate limit exceeded","status":429,"detail":"rate limit exceeded","instance":"/users","request_id":"test-request"}`
+	if rr.Body.String() != expected {
+		t.Errorf("response body: got %v, expected %v", rr.Body.String(), expected)
+	}
+}
+
+func TestRateLimitSubjects(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{JWTSecret: "jwt secret"}); err != nil {
+		t.Fatal(err)
+	}
+	app.EnableRateLimit(config.RateLimitConfig{
+		Default:  ratelimit.Limit{Requests: 1, Per: time.Minute},
+		Subjects: map[string]ratelimit.Limit{"ci": {Requests: 3, Per: time.Minute}},
+	})
+
+	tests := []struct {
+		subject string
+		allowed int
+	}{
+		{"alice", 1},
+		{"ci", 3},
+	}
+	for _, test := range tests {
+		token := hs256Token("jwt secret", test.subject, "reader")
+		for i := 0; i <= test.allowed; i++ {
+			req, _ := http.NewRequest("GET", "/users", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			app.ServeHTTP(rr, req)
+			status := http.StatusOK
+			if i == test.allowed {
+				status = http.StatusTooManyRequests
+			}
+			if rr.Code != status {
+				t.Errorf("%s request %d: http status code: got %v, expected %v", test.subject, i+1, rr.Code, status)
+			}
+		}
+	}
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	app := setup()
+	app.EnableRateLimit(config.RateLimitConfig{Default: ratelimit.Limit{Requests: 1, Per: time.Minute}})
+	app.pool.Close()
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = req.WithContext(logging.NewContext(req.Context(), app.logger))
+	rr := httptest.NewRecorder()
+	app.rateLimit(http.HandlerFunc(app.rootHandler)).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitIPCountsRejectedCredentials(t *testing.T) {
+	app := setup()
+	if err := app.EnableAuth(config.AuthConfig{JWTSecret: "jwt secret"}); err != nil {
+		t.Fatal(err)
+	}
+	app.EnableRateLimit(config.RateLimitConfig{IP: ratelimit.Limit{Requests: 2, Per: time.Minute}})
+
+	tests := []struct {
+		addr   string
+		token  string
+		status int
+	}{
+		{"10.0.0.1:1234", "bad token", http.StatusUnauthorized},
+		{"10.0.0.1:1235", "bad token", http.StatusUnauthorized},
+		{"10.0.0.1:1236", hs256Token("jwt secret", "ci", "reader"), http.StatusTooManyRequests},
+		{"10.0.0.2:1234", "bad token", http.StatusUnauthorized},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("GET", "/users", nil)
+		req.RemoteAddr = test.addr
+		req.Header.Set("Authorization", "Bearer "+test.token)
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != test.status {
+			t.Errorf("request %d from %s: http status code: got %v, expected %v", i, test.addr, rr.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+// newPool resolves the endpoint and reads the CA file once, so a bad setting
+// fails at startup rather than at the first connection
+func newPool(cfg config.RedisConfig) (*redis.Pool, error) {
+	endpoint, err := cfg.Endpoint()
+	if err != nil {
+		return nil, err
+	}
+	options, err := dialOptions(cfg, endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &redis.Pool{
+		MaxIdle:     cfg.MaxIdle,
+		MaxActive:   cfg.MaxActive,
+		IdleTimeout: cfg.IdleTimeout,
+		Wait:        true,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", endpoint.Address, options...)
+		},
+		TestOnBorrow: func(conn redis.Conn, lastUsed time.Time) error {
+			if time.Since(lastUsed) < cfg.HealthCheckInterval {
+				return nil
+			}
+			_, err := conn.Do("PING")
+			return err
+		},
+	}, nil
+}
+
+// dialOptions selects the database and sets up TLS, a CA file is trusted on
+// top of the system roots. Redigo ignores DialTLSSkipVerify along with a TLS
+// config, so the config of the CA file skips verification itself.
+func dialOptions(cfg config.RedisConfig, endpoint config.RedisEndpoint) ([]redis.DialOption, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(cfg.ConnectTimeout),
+		redis.DialReadTimeout(cfg.ReadTimeout),
+		redis.DialWriteTimeout(cfg.WriteTimeout),
+		redis.DialPassword(endpoint.Password),
+		redis.DialDatabase(endpoint.DB),
+		redis.DialUseTLS(endpoint.TLS),
+		redis.DialTLSSkipVerify(cfg.TLSSkipVerify),
+	}
+	if endpoint.TLS && cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + cfg.TLSCAFile)
+		}
+		options = append(options, redis.DialTLSConfig(&tls.Config{RootCAs: roots, InsecureSkipVerify: cfg.TLSSkipVerify}))
+	}
+	return options, nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/gomodule/redigo/redis"
+	"github.com/rnidev/go-rest/pkg/config"
+	"github.com/rnidev/go-rest/pkg/logging"
+)
+
+func TestLoadInitDataReleasesConnection(t *testing.T) {
+	app := setup()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	if inUse := app.pool.ActiveCount() - app.pool.IdleCount(); inUse != 0 {
+		t.Errorf("connections in use after loadInitData(): got %d, expected 0", inUse)
+	}
+}
+
+func TestPoolStaysBounded(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	redisConfig := config.Default().Redis
+	redisConfig.URL = s.Addr()
+	redisConfig.MaxActive = 5
+	app := &App{}
+	if err := app.Initialize(redisConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer app.pool.Close()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+
+	//sample the pool while the requests run
+	done := make(chan struct{})
+	maxActive := make(chan int)
+	go func() {
+		max := 0
+		for {
+			select {
+			case <-done:
+				maxActive <- max
+				return
+			default:
+			}
+			if active := app.pool.ActiveCount(); active > max {
+				max = active
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	const workers, requestsPerWorker = 50, 60
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < requestsPerWorker; j++ {
+				var req *http.Request
+				switch (i + j) % 3 {
+				case 0:
+					req, _ = http.NewRequest("GET", "/users", nil)
+				case 1:
+					req, _ = http.NewRequest("GET", "/user/1", nil)
+				default:
+					req, _ = http.NewRequest("POST", "/users", bytes.NewBufferString(`{"name": "John", "age": 31}`))
+				}
+				rr := httptest.NewRecorder()
+				app.ServeHTTP(rr, req)
+				if rr.Code >= http.StatusInternalServerError {
+					t.Errorf("%s %s: http status code: got %v", req.Method, req.URL, rr.Code)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+
+	if max := <-maxActive; max > redisConfig.MaxActive {
+		t.Errorf("active connections: got %d, expected at most %d", max, redisConfig.MaxActive)
+	}
+	stats := app.pool.Stats()
+	if inUse := stats.ActiveCount - stats.IdleCount; inUse != 0 {
+		t.Errorf("connections in use after %d requests: got %d, expected 0", workers*requestsPerWorker, inUse)
+	}
+}
+
+// stalledRedis listens like a Redis that accepts connections but never
+// answers, and returns its address
+func stalledRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestStalledRedisReleasesConnections(t *testing.T) {
+	redisConfig := config.Default().Redis
+	redisConfig.URL = stalledRedis(t)
+	redisConfig.MaxActive = 1
+	redisConfig.ReadTimeout = 100 * time.Millisecond
+	app := &App{logger: logging.New(io.Discard, slog.LevelInfo)}
+	if err := app.Initialize(redisConfig); err != nil {
+		t.Fatal(err)
+	}
+	defer app.pool.Close()
+
+	//the second request only gets the single connection of the pool once the
+	//first one timed out and gave it back
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		req, _ := http.NewRequest("GET", "/user/1", nil)
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("request %d: http status code: got %v, expected %v", i, rr.Code, http.StatusInternalServerError)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("request %d took %v, expected it bounded by the read timeout", i, elapsed)
+		}
+	}
+	if active := app.pool.ActiveCount(); active != 0 {
+		t.Errorf("active connections: got %d, expected the timed out ones closed", active)
+	}
+}
+
+func TestLoadInitDataKeepsChangedUsers(t *testing.T) {
+	app := setup()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("PATCH", "/user/1", bytes.NewBufferString(`{"city": "Boston"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("PATCH /user/1: http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	//a restart leaves the seeded users as they are
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	user, err := app.store.FindUserByID(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.City != "Boston" || user.Version != 2 {
+		t.Errorf("user 1 after loadInitData(): got %+v, expected city Boston at version 2", user)
+	}
+	stats, err := app.store.UserStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 2 || stats.Cities["boston"] != 1 || stats.Cities["new york"] != 0 {
+		t.Errorf("stats after loadInitData(): got %+v, expected user 1 counted in boston", stats)
+	}
+}
+
+func TestLoadInitDataSeedsOnce(t *testing.T) {
+	app := setup()
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/user/1", "/user/2"} {
+		req, _ := http.NewRequest("DELETE", path, nil)
+		rr := httptest.NewRecorder()
+		app.ServeHTTP(rr, req)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("DELETE %s: http status code: got %v, expected %v", path, rr.Code, http.StatusNoContent)
+		}
+	}
+
+	//a restart does not bring the deleted seed users back
+	if err := app.loadInitData(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.store.FindUserByID(context.Background(), 2); err == nil {
+		t.Errorf("user 2 after loadInitData(): got a user, expected the deleted seed user to stay deleted")
+	}
+
+	//new users get IDs past the seeded ones, so old ETags cannot match them
+	req, _ := http.NewRequest("POST", "/users", bytes.NewBufferString(`{"name": "Jane", "age": 40}`))
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/user/3" {
+		t.Errorf("POST /users: got %v at %q, expected %v at /user/3", rr.Code, rr.Header().Get("Location"), http.StatusCreated)
+	}
+}
+
+// writeCAFile writes a self-signed CA certificate, which signs no server, as a
+// PEM file
+func writeCAFile(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDialOptionsTLSSkipVerifyWithCAFile(t *testing.T) {
+	//the handshake is all the dial does without a password or a database
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	cfg := config.RedisConfig{URL: "rediss://" + address, TLSCAFile: writeCAFile(t)}
+	for _, skipVerify := range []bool{false, true} {
+		cfg.TLSSkipVerify = skipVerify
+		endpoint, err := cfg.Endpoint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		options, err := dialOptions(cfg, endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := redis.Dial("tcp", endpoint.Address, options...)
+		if skipVerify && err != nil {
+			t.Errorf("skip verify with a CA file: got %v, expected the certificate to be accepted", err)
+		}
+		if !skipVerify && err == nil {
+			t.Errorf("CA file alone: got nil, expected the certificate to be rejected")
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestNewPoolReadsCAFileOnce(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	cfg := config.Default().Redis
+	cfg.URL = "rediss://" + server.Listener.Addr().String()
+	cfg.TLSSkipVerify = true
+
+	cfg.TLSCAFile = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newPool(cfg); err == nil {
+		t.Errorf("missing CA file: got nil, expected newPool() to fail")
+	}
+
+	cfg.TLSCAFile = writeCAFile(t)
+	pool, err := newPool(cfg)
+	if err != nil {
+		t.Fatalf("error: got %s, expected no error", err.Error())
+	}
+	defer pool.Close()
+	//connections are dialed with the CA read by newPool
+	if err := os.Remove(cfg.TLSCAFile); err != nil {
+		t.Fatal(err)
+	}
+	conn := pool.Get()
+	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		t.Errorf("dial after the CA file is gone: got %v, expected no error", err)
+	}
+}
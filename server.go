@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+// startServer listens on cfg.Port and serves until ctx is done, a listen error
+// is returned right away so startup failures are not silent
+func (app *App) startServer(ctx context.Context, cfg config.ServerConfig) error {
+	listener, err := net.Listen("tcp", ":"+cfg.Port)
+	if err != nil {
+		return err
+	}
+	app.logger.Info("listening", slog.String("port", cfg.Port))
+	return app.serve(ctx, listener, cfg)
+}
+
+// serve handles requests on listener until ctx is done, then reports not ready
+// for cfg.ShutdownDrain while still serving, stops accepting connections and
+// waits up to cfg.ShutdownTimeout for in-flight requests
+func (app *App) serve(ctx context.Context, listener net.Listener, cfg config.ServerConfig) error {
+	srv := &http.Server{
+		Handler:      app,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	//fail readiness first and keep serving until load balancers have seen it
+	app.health.shuttingDown.Store(true)
+	if cfg.ShutdownDrain > 0 {
+		app.logger.Info("draining", slog.Duration("delay", cfg.ShutdownDrain))
+		drain := time.NewTimer(cfg.ShutdownDrain)
+		defer drain.Stop()
+		select {
+		case err := <-serveErr:
+			return err
+		case <-drain.C:
+		}
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rnidev/go-rest/pkg/config"
+)
+
+func TestStartServerListenError(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	app := &App{Router: mux.NewRouter(), logger: slog.Default()}
+	cfg := config.Default().Server
+	cfg.Port = port
+	if err := app.startServer(context.Background(), cfg); err == nil {
+		t.Errorf("error: got nil, expected the port to be in use")
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	app := &App{Router: mux.NewRouter(), logger: slog.Default()}
+	app.Router.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	cfg := config.Default().Server
+	cfg.ShutdownDrain = 0
+	go func() {
+		served <- app.serve(ctx, listener, cfg)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/slow")
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{body: string(body), err: err}
+	}()
+
+	<-started
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("serve() error: got %s, expected no error", err.Error())
+	}
+	res := <-responses
+	if res.err != nil || res.body != "done" {
+		t.Errorf("in-flight request: got %q, %v, expected it to complete", res.body, res.err)
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/slow"); err == nil {
+		t.Errorf("server still accepts requests after shutdown")
+	}
+}
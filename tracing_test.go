@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans installs a tracer provider keeping the ended spans in memory
+// until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	})
+	return recorder
+}
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans(t)
+	app := setup()
+	conn := app.pool.Get()
+	defer conn.Close()
+	if err := loadInitUserData(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("GET", "/user/1", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	app.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("http status code: got %v, expected %v", rr.Code, http.StatusOK)
+	}
+
+	var server sdktrace.ReadOnlySpan
+	var redisSpans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.SpanKind() {
+		case trace.SpanKindServer:
+			server = span
+		case trace.SpanKindClient:
+			redisSpans = append(redisSpans, span)
+		}
+	}
+	if server == nil {
+		t.Fatal("no server span recorded")
+	}
+	if server.Name() != "GET /user/{id:[0-9]+}" {
+		t.Errorf("server span name: got %s, expected GET /user/{id:[0-9]+}", server.Name())
+	}
+	if traceID := server.SpanContext().TraceID().String(); traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("server span trace ID: got %s, expected the one of the traceparent header", traceID)
+	}
+	if parent := server.Parent().SpanID().String(); parent != "00f067aa0ba902b7" {
+		t.Errorf("server span parent: got %s, expected the span of the traceparent header", parent)
+	}
+	if status := spanAttribute(server, "http.response.status_code").AsInt64(); status != http.StatusOK {
+		t.Errorf("server span status code: got %d, expected %d", status, http.StatusOK)
+	}
+	if id := spanAttribute(server, "request.id").AsString(); id != rr.Header().Get("X-Request-ID") {
+		t.Errorf("server span request.id: got %s, expected %s", id, rr.Header().Get("X-Request-ID"))
+	}
+
+	if len(redisSpans) != 1 || redisSpans[0].Name() != "redis PIPELINE" {
+		t.Fatalf("redis spans: got %v, expected one PIPELINE span", redisSpans)
+	}
+	if redisSpans[0].Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Errorf("redis span parent: got %s, expected the server span", redisSpans[0].Parent().SpanID())
+	}
+}